@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	rh "github.com/hashicorp/go-retryablehttp"
+)
+
+const defaultMercuryURL = "https://api.mercury.com/api/v1"
+
+// Client talks to the Mercury and InvoiceNinja APIs on behalf of a config
+type Client struct {
+	config *Config
+	http   *rh.Client
+	// Same as http, except for the TLS settings of self-hosted instances
+	invoiceNinjaHTTP *rh.Client
+	// Slots for writes to InvoiceNinja, shared by all accounts to bound their rate
+	invoiceNinjaWrites chan struct{}
+	// Set once InvoiceNinja is seen not to store the transaction reference
+	referenceUnstored atomic.Bool
+
+	// Base URLs of the APIs, which tests can point at a mock server
+	mercuryURL      string
+	invoiceNinjaURL string
+}
+
+func newClient(config *Config) *Client {
+	invoiceNinjaHTTP := newRetryClient(config)
+	if config.invoiceNinjaCAs != nil || config.InvoiceNinjaInsecureSkipVerify {
+		if config.InvoiceNinjaInsecureSkipVerify {
+			slog.Warn("Not verifying the InvoiceNinja TLS certificate")
+		}
+		invoiceNinjaHTTP.HTTPClient.Transport.(*http.Transport).TLSClientConfig = &tls.Config{
+			RootCAs:            config.invoiceNinjaCAs,
+			InsecureSkipVerify: config.InvoiceNinjaInsecureSkipVerify,
+		}
+	}
+
+	return &Client{
+		config:           config,
+		http:             newRetryClient(config),
+		invoiceNinjaHTTP: invoiceNinjaHTTP,
+		mercuryURL:       defaultMercuryURL,
+		invoiceNinjaURL:  config.InvoiceNinjaURL + "/api/v1",
+
+		invoiceNinjaWrites: make(chan struct{}, config.InvoiceNinjaConcurrency),
+	}
+}
+
+func newRetryClient(config *Config) *rh.Client {
+	httpClient := rh.NewClient()
+	httpClient.RetryMax = config.HTTPRetryMax
+	httpClient.RetryWaitMin = time.Duration(config.HTTPRetryWaitMinSeconds) * time.Second
+	httpClient.RetryWaitMax = time.Duration(config.HTTPRetryWaitMaxSeconds) * time.Second
+	// HTTPS_PROXY and NO_PROXY still apply when no proxy is configured
+	if config.httpProxyURL != nil {
+		httpClient.HTTPClient.Transport.(*http.Transport).Proxy = http.ProxyURL(config.httpProxyURL)
+	}
+	// Applies to each attempt rather than to all retries of a request
+	httpClient.HTTPClient.Timeout = time.Duration(config.HTTPTimeoutSeconds) * time.Second
+	httpClient.CheckRetry = retryPolicy
+	httpClient.Backoff = retryBackoff
+	// Return the last response once retries run out, so that its status becomes an APIError
+	httpClient.ErrorHandler = rh.PassthroughErrorHandler
+	// Route the retry logs through slog, so that they are redacted like the rest
+	httpClient.Logger = nil
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		httpClient.Logger = slog.Default()
+	}
+	return httpClient
+}
+
+func isRateLimited(resp *http.Response) bool {
+	return resp != nil &&
+		(resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable)
+}
+
+// retryPolicy retries rate-limited requests, and otherwise follows the default policy
+func retryPolicy(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if isRateLimited(resp) {
+		slog.Warn("Request was rate limited, retrying", "method", resp.Request.Method,
+			"url", resp.Request.URL, "status", resp.StatusCode, "retry_after", resp.Header.Get("Retry-After"))
+		return true, nil
+	}
+	return rh.DefaultRetryPolicy(ctx, resp, err)
+}
+
+// retryBackoff waits as long as the Retry-After header of a rate-limited response asks,
+// and backs off exponentially otherwise
+func retryBackoff(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
+	if isRateLimited(resp) {
+		if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return wait
+		}
+	}
+	return rh.DefaultBackoff(min, max, attemptNum, nil)
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return max(time.Until(date), 0), true
+}
+
+var (
+	errAuth        = errors.New("unauthorized")
+	errNotFound    = errors.New("not found")
+	errRateLimited = errors.New("rate limited")
+)
+
+// isFatal reports whether retrying the failed requests on the next sync won't help,
+// such as with a revoked or mistyped token
+func isFatal(err error) bool {
+	return errors.Is(err, errAuth)
+}
+
+// APIError is returned for responses outside the 2xx range
+type APIError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+	// Field errors of InvoiceNinja validation failures, as "field: message"
+	ValidationErrors []string
+}
+
+func (e *APIError) Error() string {
+	if len(e.ValidationErrors) > 0 {
+		return fmt.Sprintf("error submitting request: %s %s: %d %s", e.Method, e.URL, e.StatusCode,
+			strings.Join(e.ValidationErrors, "; "))
+	}
+	return fmt.Sprintf("error submitting request: %s %s: %d %s", e.Method, e.URL, e.StatusCode, e.Body)
+}
+
+// parseValidationErrors returns the field errors of an InvoiceNinja 422 response, such as
+// {"message": "The given data was invalid.", "errors": {"date": ["The date field is required."]}}
+func parseValidationErrors(body []byte) []string {
+	var res struct {
+		Errors map[string][]string `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil
+	}
+	var errs []string
+	for _, field := range slices.Sorted(maps.Keys(res.Errors)) {
+		for _, msg := range res.Errors[field] {
+			errs = append(errs, field+": "+msg)
+		}
+	}
+	return errs
+}
+
+// Unwrap lets callers match the kinds of failures they handle with errors.Is
+func (e *APIError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return errAuth
+	case http.StatusNotFound:
+		return errNotFound
+	case http.StatusTooManyRequests:
+		return errRateLimited
+	}
+	return nil
+}
+
+// secretHeaders are redacted wherever requests or responses are logged
+var secretHeaders = []string{"Authorization", "X-API-Token"}
+
+func isSecretHeader(name string) bool {
+	return slices.ContainsFunc(secretHeaders, func(secret string) bool {
+		return strings.EqualFold(secret, name)
+	})
+}
+
+func redactHeaders(headers http.Header) http.Header {
+	redacted := headers.Clone()
+	for name := range redacted {
+		if isSecretHeader(name) {
+			redacted[name] = []string{"***"}
+		}
+	}
+	return redacted
+}
+
+func (c *Client) submitRequest(req *rh.Request, res any) error {
+	if c.config.TraceHTTP {
+		body, _ := req.BodyBytes()
+		slog.Info("API request", "method", req.Method, "url", req.URL,
+			"headers", redactHeaders(req.Header), "body", string(body))
+	}
+
+	// Bound all attempts together, so that retries of a hung request don't multiply its timeout
+	if c.config.HTTPDeadlineSeconds > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), time.Duration(c.config.HTTPDeadlineSeconds)*time.Second)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	httpClient := c.http
+	if strings.HasPrefix(req.URL.String(), c.invoiceNinjaURL) {
+		httpClient = c.invoiceNinjaHTTP
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error submitting request: %s %s: %v", req.Method, req.URL, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response body: %v", err)
+	}
+	if c.config.TraceHTTP {
+		slog.Info("API response", "method", req.Method, "url", req.URL, "status", resp.StatusCode,
+			"headers", redactHeaders(resp.Header), "body", string(body))
+	} else {
+		slog.Debug("API response", "method", req.Method, "url", req.URL,
+			"status", resp.StatusCode, "body", string(body))
+	}
+
+	// InvoiceNinja answers creations with 201 or 202
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &APIError{
+			Method:     req.Method,
+			URL:        req.URL.String(),
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
+		}
+		if resp.StatusCode == http.StatusUnprocessableEntity {
+			apiErr.ValidationErrors = parseValidationErrors(body)
+		}
+		return apiErr
+	}
+
+	// Such as 204 No Content, or a caller that doesn't need the response
+	if len(body) == 0 || res == nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, res); err != nil {
+		return fmt.Errorf("error parsing JSON response: %s %s: %s %v",
+			req.Method, req.URL, string(body), err)
+	}
+	return nil
+}
+
+func getRequest(ctx context.Context, method string, url string, headers map[string]string, body any) (*rh.Request, error) {
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling body: %s %s: %s %v", method, url, string(b), err)
+		}
+		body = b
+	}
+	req, err := rh.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %s %s: %v", method, url, err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
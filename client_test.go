@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testConfig returns a config loaded like the real one, from a file with
+// test credentials and no HTTP retries, changed by the given settings
+func testConfig(t *testing.T, settings map[string]any) *Config {
+	t.Helper()
+	config, err := loadTestConfig(t, settings)
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+	return config
+}
+
+// loadTestConfig is testConfig for settings that may be invalid
+func loadTestConfig(t *testing.T, settings map[string]any) (*Config, error) {
+	t.Helper()
+	file := map[string]any{
+		"mercuryAPIKey":     "test-mercury-key",
+		"invoiceNinjaToken": "test-invoice-ninja-token",
+		"httpRetryMax":      0,
+	}
+	for k, v := range settings {
+		file[k] = v
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return loadConfig(path, dir, "https://invoiceninja.test")
+}
+
+// newTestClient returns a client whose Mercury and InvoiceNinja APIs are served by the
+// given handlers, keyed by ServeMux patterns under /mercury and /invoiceninja
+func newTestClient(t *testing.T, config *Config, routes map[string]http.HandlerFunc) *Client {
+	t.Helper()
+	mux := http.NewServeMux()
+	for pattern, handler := range routes {
+		mux.HandleFunc(pattern, handler)
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	c := newClient(config)
+	c.mercuryURL = server.URL + "/mercury"
+	c.invoiceNinjaURL = server.URL + "/invoiceninja"
+	return c
+}
+
+func writeJSON(t *testing.T, w http.ResponseWriter, status int, v any) {
+	t.Helper()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientUsesBaseURLs(t *testing.T) {
+	config := testConfig(t, nil)
+	c := newTestClient(t, config, map[string]http.HandlerFunc{
+		"GET /mercury/accounts": func(w http.ResponseWriter, r *http.Request) {
+			if got := r.Header.Get("Authorization"); got != "Bearer test-mercury-key" {
+				t.Errorf("Authorization = %q", got)
+			}
+			writeJSON(t, w, http.StatusOK, map[string]any{
+				"accounts": []map[string]string{{"id": "acct-1", "name": "Checking"}},
+			})
+		},
+		"GET /invoiceninja/bank_integrations": func(w http.ResponseWriter, r *http.Request) {
+			if got := r.Header.Get("X-API-Token"); got != "test-invoice-ninja-token" {
+				t.Errorf("X-API-Token = %q", got)
+			}
+			writeJSON(t, w, http.StatusOK, map[string]any{
+				"data": []map[string]string{{"id": "bi-1", "provider_name": "Mercury"}},
+			})
+		},
+	})
+
+	ctx := context.Background()
+	if err := c.fetchBankIntegrations(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.fetchMercuryAccounts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.mercuryAccounts) != 1 || config.mercuryAccounts[0].bankIntegrationID != "bi-1" {
+		t.Errorf("accounts = %+v", config.mercuryAccounts)
+	}
+}
+
+func TestSubmitRequestParsesCreatedBody(t *testing.T) {
+	for _, status := range []int{http.StatusCreated, http.StatusAccepted} {
+		c := newTestClient(t, testConfig(t, nil), map[string]http.HandlerFunc{
+			"POST /invoiceninja/bank_transactions": func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(t, w, status, map[string]any{"data": map[string]string{"id": "bt-1"}})
+			},
+		})
+		req, err := c.getInvoiceNinjaRequest(context.Background(), "POST", "/bank_transactions", &InvoiceNinjaBankTX{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res struct {
+			Data InvoiceNinjaBankTX `json:"data"`
+		}
+		if err := c.submitRequest(req, &res); err != nil {
+			t.Fatalf("%d: %v", status, err)
+		}
+		if res.Data.ID != "bt-1" {
+			t.Errorf("%d: ID = %q, want bt-1", status, res.Data.ID)
+		}
+	}
+}
+
+func TestRetryOnRateLimit(t *testing.T) {
+	attempts := 0
+	c := newTestClient(t, testConfig(t, map[string]any{"httpRetryMax": 2}), map[string]http.HandlerFunc{
+		"GET /mercury/accounts": func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			if attempts == 1 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			writeJSON(t, w, http.StatusOK, map[string]any{"accounts": []any{}})
+		},
+	})
+
+	if err := c.checkMercury(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("got %d attempts, want 2", attempts)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"120", 2 * time.Minute, true},
+		{"-5", 0, false},
+		{time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), time.Hour, true},
+		{"Mon, 01 Jan 2001 00:00:00 GMT", 0, true},
+		{"", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value)
+		// HTTP dates have a resolution of a second, and the clock moves on meanwhile
+		if ok != tt.ok || got > tt.want || got < tt.want-2*time.Second {
+			t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSubmitRequestStatuses(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		wantID string
+		err    bool
+	}{
+		{http.StatusOK, `{"data": {"id": "bt-1"}}`, "bt-1", false},
+		{http.StatusCreated, `{"data": {"id": "bt-2"}}`, "bt-2", false},
+		{http.StatusNoContent, ``, "", false},
+		{http.StatusBadRequest, `{"message": "bad request"}`, "", true},
+	}
+	for _, tt := range tests {
+		c := newTestClient(t, testConfig(t, nil), map[string]http.HandlerFunc{
+			"POST /invoiceninja/bank_transactions": func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			},
+		})
+		req, err := c.getInvoiceNinjaRequest(context.Background(), "POST", "/bank_transactions", &InvoiceNinjaBankTX{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res struct {
+			Data InvoiceNinjaBankTX `json:"data"`
+		}
+		err = c.submitRequest(req, &res)
+		if res.Data.ID != tt.wantID {
+			t.Errorf("%d: ID = %q, want %q", tt.status, res.Data.ID, tt.wantID)
+		}
+		if !tt.err {
+			if err != nil {
+				t.Errorf("%d: %v", tt.status, err)
+			}
+			continue
+		}
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != tt.status || apiErr.Body != tt.body {
+			t.Errorf("%d: error = %v, want an APIError with the status and body", tt.status, err)
+		}
+	}
+}
+
+// slowHandler answers only after the given delay, unless the client gives up first
+func slowHandler(delay time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(delay):
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	c := newTestClient(t, testConfig(t, map[string]any{"httpTimeoutSeconds": 1}), map[string]http.HandlerFunc{
+		"GET /mercury/accounts": slowHandler(10 * time.Second),
+	})
+
+	start := time.Now()
+	err := c.checkMercury(context.Background())
+	if err == nil {
+		t.Fatal("request to a hung server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("request took %v despite a timeout of 1s", elapsed)
+	}
+}
+
+func TestRequestDeadlineCoversRetries(t *testing.T) {
+	c := newTestClient(t, testConfig(t, map[string]any{
+		"httpTimeoutSeconds":      1,
+		"httpDeadlineSeconds":     2,
+		"httpRetryMax":            5,
+		"httpRetryWaitMinSeconds": 0,
+		"httpRetryWaitMaxSeconds": 0,
+	}), map[string]http.HandlerFunc{
+		"GET /mercury/accounts": slowHandler(10 * time.Second),
+	})
+
+	start := time.Now()
+	err := c.checkMercury(context.Background())
+	if err == nil {
+		t.Fatal("request to a hung server succeeded")
+	}
+	// Without the deadline, the 6 attempts would take 6s
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("request took %v despite a deadline of 2s", elapsed)
+	}
+}
+
+func TestIsFatal(t *testing.T) {
+	apiErr := func(status int) error {
+		return &APIError{Method: "GET", URL: "https://api.test/", StatusCode: status}
+	}
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{apiErr(http.StatusUnauthorized), true},
+		{apiErr(http.StatusForbidden), true},
+		{fmt.Errorf("error fetching transactions of account Checking: %w", apiErr(http.StatusUnauthorized)), true},
+		{apiErr(http.StatusNotFound), false},
+		{apiErr(http.StatusTooManyRequests), false},
+		{apiErr(http.StatusInternalServerError), false},
+		{apiErr(http.StatusUnprocessableEntity), false},
+		{errors.New("error submitting request: connection refused"), false},
+		{context.DeadlineExceeded, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := isFatal(tt.err); got != tt.want {
+			t.Errorf("isFatal(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// healthStatus tracks what the /healthz and /readyz endpoints report
+type healthStatus struct {
+	mu          sync.Mutex
+	readySince  time.Time
+	lastSync    time.Time
+	lastErr     error
+	lastSuccess time.Time
+	lastStatus  *LastSyncStatus
+	// Bounds how stale the last sync may be, and changes when the config is reloaded
+	syncInterval time.Duration
+}
+
+// LastSyncStatus is what the /status endpoint reports about the last sync
+type LastSyncStatus struct {
+	Time      time.Time `json:"time"`
+	Processed int       `json:"processed"`
+	Skipped   int       `json:"skipped"`
+	Failed    int       `json:"failed"`
+	// Processed transactions by account name
+	Accounts map[string]int `json:"accounts"`
+	Error    string         `json:"error,omitempty"`
+}
+
+var health = &healthStatus{}
+
+// setReady is called once the bank integration and Mercury accounts are fetched
+func (h *healthStatus) setReady() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.readySince = time.Now()
+}
+
+func (h *healthStatus) setSyncInterval(interval time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.syncInterval = interval
+}
+
+func (h *healthStatus) recordSync(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSync = time.Now()
+	h.lastErr = err
+	if err == nil {
+		h.lastSuccess = h.lastSync
+	}
+}
+
+func (h *healthStatus) recordStatus(status *LastSyncStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastStatus = status
+}
+
+func (h *healthStatus) status() *LastSyncStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastStatus
+}
+
+func (h *healthStatus) lastSuccessfulSync() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastSuccess
+}
+
+// checkReady returns nil when the startup lookups have succeeded
+// and the last sync succeeded within twice the sync interval
+func (h *healthStatus) checkReady() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.readySince.IsZero() {
+		return errors.New("not initialized")
+	}
+	if h.lastErr != nil {
+		return fmt.Errorf("last sync failed: %v", h.lastErr)
+	}
+	last := h.lastSync
+	if last.IsZero() {
+		last = h.readySince
+	}
+	if time.Since(last) > 2*h.syncInterval {
+		return fmt.Errorf("last sync is stale: %s", last.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func startHealthServer(ctx context.Context, config *Config) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		status := health.status()
+		if status == nil {
+			http.Error(w, "no sync has run yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		lastSuccess := "never"
+		if ts := health.lastSuccessfulSync(); !ts.IsZero() {
+			lastSuccess = ts.Format(time.RFC3339)
+		}
+		if err := health.checkReady(); err != nil {
+			http.Error(w, fmt.Sprintf("%v\nlast successful sync: %s", err, lastSuccess),
+				http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "ok\nlast successful sync: %s\n", lastSuccess)
+	})
+
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", config.HealthPort),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	go func() {
+		slog.Debug("Starting health server", "addr", server.Addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("Error in health server", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	rh "github.com/hashicorp/go-retryablehttp"
+)
+
+type InvoiceNinjaBankTX struct {
+	ID                string  `json:"id,omitempty"`
+	Amount            float64 `json:"amount"`
+	Date              string  `json:"date"`
+	Description       string  `json:"description"`
+	BankIntegrationID string  `json:"bank_integration_id"`
+	BaseType          string  `json:"base_type"`
+	CurrencyID        string  `json:"currency_id,omitempty"`
+	// Mercury transaction ID, so the transaction can be found again without local state
+	TransactionReference string `json:"transaction_reference,omitempty"`
+}
+
+type InvoiceNinjaPagination struct {
+	CurrentPage int `json:"current_page"`
+	TotalPages  int `json:"total_pages"`
+}
+
+type BankIntegration struct {
+	ID           string `json:"id"`
+	ProviderName string `json:"provider_name"`
+}
+
+func (c *Client) getInvoiceNinjaRequest(ctx context.Context, method string, url string, body any) (*rh.Request, error) {
+	headers := map[string]string{
+		"X-API-Token":      c.config.InvoiceNinjaToken,
+		"X-Requested-With": "XMLHttpRequest",
+	}
+	return getRequest(ctx, method, c.invoiceNinjaURL+url, headers, body)
+}
+
+// submitWrite submits a request that writes to InvoiceNinja once one of the
+// invoiceNinjaConcurrency slots is free. The slot is held while a rate-limited
+// request waits to be retried, so that the other writers back off as well.
+func (c *Client) submitWrite(req *rh.Request, res any) error {
+	select {
+	case c.invoiceNinjaWrites <- struct{}{}:
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+	defer func() { <-c.invoiceNinjaWrites }()
+	return c.submitRequest(req, res)
+}
+
+// checkCompany verifies that the token is valid and, if a company key is configured,
+// that it belongs to that company.
+// InvoiceNinja tokens are scoped to a single company, so it can't be selected per request.
+func (c *Client) checkCompany(ctx context.Context) error {
+	req, err := c.getInvoiceNinjaRequest(ctx, "GET", "/companies/current", nil)
+	if err != nil {
+		return err
+	}
+	var res struct {
+		Data struct {
+			CompanyKey string `json:"company_key"`
+		} `json:"data"`
+	}
+	if err = c.submitRequest(req, &res); err != nil {
+		return err
+	}
+	if c.config.InvoiceNinjaCompanyKey != "" && res.Data.CompanyKey != c.config.InvoiceNinjaCompanyKey {
+		return fmt.Errorf("InvoiceNinja token belongs to company %s, not %s",
+			res.Data.CompanyKey, c.config.InvoiceNinjaCompanyKey)
+	}
+	return nil
+}
+
+// fetchBankIntegrations looks up the IDs of all InvoiceNinja bank integrations by provider name
+func (c *Client) fetchBankIntegrations(ctx context.Context) error {
+	slog.Debug("Fetching InvoiceNinja bank integrations")
+
+	integrations := make(map[string]string)
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("/bank_integrations?page=%d&per_page=100", page)
+		req, err := c.getInvoiceNinjaRequest(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+		var res struct {
+			Integrations []*BankIntegration `json:"data"`
+			Meta         struct {
+				Pagination InvoiceNinjaPagination `json:"pagination"`
+			} `json:"meta"`
+		}
+		if err = c.submitRequest(req, &res); err != nil {
+			return err
+		}
+
+		for _, ig := range res.Integrations {
+			if _, ok := integrations[ig.ProviderName]; !ok {
+				slog.Debug("Found bank integration", "provider", ig.ProviderName, "id", ig.ID)
+				integrations[ig.ProviderName] = ig.ID
+			}
+		}
+
+		// Older InvoiceNinja versions omit pagination metadata, so also stop on an empty page
+		if len(res.Integrations) == 0 || page >= res.Meta.Pagination.TotalPages {
+			break
+		}
+	}
+	// Such as when the bank was reconnected since the last fetch
+	for provider, id := range c.config.bankIntegrations {
+		if newID, ok := integrations[provider]; ok && newID != id {
+			slog.Info("Bank integration changed", "provider", provider, "id", newID, "previous_id", id)
+		}
+	}
+	c.config.bankIntegrations = integrations
+	return nil
+}
+
+// accountBankIntegrationID returns the integration of the provider mapped to the account
+// by its ID or name, falling back to the global bank provider
+func accountBankIntegrationID(config *Config, acct *MercuryAccount) (string, error) {
+	provider, ok := config.AccountBankProviders[acct.ID]
+	if !ok {
+		provider, ok = config.AccountBankProviders[acct.Name]
+	}
+	if !ok {
+		provider = config.BankProvider
+	}
+	id, ok := config.bankIntegrations[provider]
+	if !ok {
+		return "", fmt.Errorf("no bank integration found for provider: %s (checked %d integrations)",
+			provider, len(config.bankIntegrations))
+	}
+	return id, nil
+}
+
+// bankIntegrationIDs returns the distinct integrations the accounts are synced to
+func (c *Client) bankIntegrationIDs() []string {
+	var ids []string
+	for _, acct := range c.config.mercuryAccounts {
+		if !slices.Contains(ids, acct.bankIntegrationID) {
+			ids = append(ids, acct.bankIntegrationID)
+		}
+	}
+	return ids
+}
+
+// fetchInvoiceNinjaTransactions returns the existing bank transactions
+// of the accounts' integrations dated on or after the given day
+func (c *Client) fetchInvoiceNinjaTransactions(ctx context.Context, since string) ([]*InvoiceNinjaBankTX, error) {
+	slog.Debug("Fetching InvoiceNinja bank transactions", "since", since)
+
+	integrationIDs := c.bankIntegrationIDs()
+	var txs []*InvoiceNinjaBankTX
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("/bank_transactions?bank_integration_ids=%s&sort=date|desc&page=%d&per_page=100",
+			url.QueryEscape(strings.Join(integrationIDs, ",")), page)
+		req, err := c.getInvoiceNinjaRequest(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		var res struct {
+			Transactions []*InvoiceNinjaBankTX `json:"data"`
+			Meta         struct {
+				Pagination InvoiceNinjaPagination `json:"pagination"`
+			} `json:"meta"`
+		}
+		if err = c.submitRequest(req, &res); err != nil {
+			return nil, err
+		}
+
+		// Results are sorted newest first, so stop at the first one outside the window
+		for _, tx := range res.Transactions {
+			if tx.Date < since {
+				return txs, nil
+			}
+			if slices.Contains(integrationIDs, tx.BankIntegrationID) {
+				txs = append(txs, tx)
+			}
+		}
+
+		if len(res.Transactions) == 0 || page >= res.Meta.Pagination.TotalPages {
+			break
+		}
+	}
+	return txs, nil
+}
+
+// defaultCurrencyIDs are the InvoiceNinja currency IDs by ISO code,
+// which the currencyIDs setting extends
+var defaultCurrencyIDs = map[string]string{
+	"USD": "1",
+	"GBP": "2",
+	"EUR": "3",
+}
+
+func invoiceNinjaCurrencyID(config *Config, tx *MercuryTransaction) (string, error) {
+	code := strings.ToUpper(tx.Currency)
+	if code == "" {
+		code = "USD"
+	}
+	id, ok := config.CurrencyIDs[code]
+	if !ok {
+		return "", fmt.Errorf("no InvoiceNinja currency ID configured for currency: %s", code)
+	}
+	return id, nil
+}
+
+// Conservative limit on the length of descriptions, which InvoiceNinja may shorten
+const maxDescriptionLen = 255
+
+// appendTxID reports whether descriptions are suffixed with the Mercury ID: always or never
+// if appendTxIDToDescription is set, and otherwise once InvoiceNinja is seen not to store
+// the transaction reference, since the suffix is then the only way to find them again
+func (c *Client) appendTxID() bool {
+	if c.config.AppendTxIDToDescription != nil {
+		return *c.config.AppendTxIDToDescription
+	}
+	return c.referenceUnstored.Load()
+}
+
+// description returns the description of the transaction, suffixed with its Mercury ID
+// if appendTxID says so
+func (c *Client) description(tx *MercuryTransaction) string {
+	desc := renderDescription(c.config, tx)
+	if !c.appendTxID() {
+		return desc
+	}
+	suffix := fmt.Sprintf(" [mercury:%s]", tx.ID)
+	// Shorten the description rather than the suffix, so the ID stays intact
+	if runes := []rune(desc); len(runes)+len(suffix) > maxDescriptionLen {
+		desc = string(runes[:max(maxDescriptionLen-len(suffix), 0)])
+	}
+	return desc + suffix
+}
+
+// renderDescription renders the descriptionTemplate for the transaction,
+// falling back to its bank description
+func renderDescription(config *Config, tx *MercuryTransaction) string {
+	if config.descriptionTemplate == nil {
+		return tx.BankDescription
+	}
+	var b strings.Builder
+	if err := config.descriptionTemplate.Execute(&b, tx); err != nil {
+		slog.Warn("Error rendering transaction description", "id", tx.ID, "error", err)
+		return tx.BankDescription
+	}
+	return b.String()
+}
+
+// mercuryIDSuffix matches the Mercury ID that appendTxIDToDescription suffixes descriptions with
+var mercuryIDSuffix = regexp.MustCompile(`\[mercury:([^\]]+)\]$`)
+
+// mercuryTxID returns the ID of the Mercury transaction an InvoiceNinja transaction was created
+// from, taken from its reference or else from its description, or an empty string if neither has it
+func mercuryTxID(tx *InvoiceNinjaBankTX) string {
+	if tx.TransactionReference != "" {
+		return tx.TransactionReference
+	}
+	if m := mercuryIDSuffix.FindStringSubmatch(strings.TrimSpace(tx.Description)); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// noteReference learns from an existing transaction whether InvoiceNinja stores the reference:
+// one found by its description suffix alone was created by an instance that doesn't
+func (c *Client) noteReference(tx *InvoiceNinjaBankTX) {
+	if tx.TransactionReference == "" && mercuryTxID(tx) != "" {
+		c.referenceUnstored.Store(true)
+	}
+}
+
+func (c *Client) newInvoiceNinjaBankTX(acct *MercuryAccount, tx *MercuryTransaction) *InvoiceNinjaBankTX {
+	baseType := "DEBIT"
+	if tx.Amount > 0 {
+		baseType = "CREDIT"
+	}
+
+	return &InvoiceNinjaBankTX{
+		Amount:            math.Abs(tx.Amount),
+		Date:              tx.date(c.config.DateField).Format("2006-01-02"),
+		Description:       c.description(tx),
+		BankIntegrationID: acct.bankIntegrationID,
+		BaseType:          baseType,
+
+		TransactionReference: tx.ID,
+	}
+}
+
+// findInvoiceNinjaTransaction returns the ID of the bank transaction created
+// from the given Mercury transaction, or an empty string if there is none
+func (c *Client) findInvoiceNinjaTransaction(ctx context.Context, txID string) (string, error) {
+	// Neither the reference nor a description suffix would match it
+	if c.referenceUnstored.Load() && !c.appendTxID() {
+		return "", nil
+	}
+	url := fmt.Sprintf("/bank_transactions?filter=%s&bank_integration_ids=%s",
+		url.QueryEscape(txID), url.QueryEscape(strings.Join(c.bankIntegrationIDs(), ",")))
+	req, err := c.getInvoiceNinjaRequest(ctx, "GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		Transactions []*InvoiceNinjaBankTX `json:"data"`
+	}
+	if err = c.submitRequest(req, &res); err != nil {
+		return "", err
+	}
+
+	// The filter is a fuzzy search, so require an exact match
+	for _, tx := range res.Transactions {
+		if mercuryTxID(tx) == txID {
+			return tx.ID, nil
+		}
+	}
+	return "", nil
+}
+
+// idempotencyKey is stable across retries of creating the same transaction, so a server that
+// honors the Idempotency-Key header doesn't create it twice. InvoiceNinja ignores it,
+// so the Mercury ID in the reference or description is what dedup relies on there.
+func idempotencyKey(txID string) string {
+	sum := sha256.Sum256([]byte("mercury:" + txID))
+	return hex.EncodeToString(sum[:])
+}
+
+// createInvoiceNinjaTransaction returns the ID of the created transaction
+func (c *Client) createInvoiceNinjaTransaction(ctx context.Context, acct *MercuryAccount, tx *MercuryTransaction) (string, error) {
+	slog.Debug("Creating bank transaction in InvoiceNinja",
+		"amount", tx.Amount, "description", tx.BankDescription, "status", tx.Status)
+
+	bankTx := c.newInvoiceNinjaBankTX(acct, tx)
+	currencyID, err := invoiceNinjaCurrencyID(c.config, tx)
+	if err != nil {
+		return "", err
+	}
+	bankTx.CurrencyID = currencyID
+	if c.config.DryRun {
+		slog.Info("Dry run: would create bank transaction", "id", tx.ID, "account", acct.Name,
+			"amount", bankTx.Amount, "date", bankTx.Date, "base_type", bankTx.BaseType,
+			"description", bankTx.Description)
+		return "", nil
+	}
+
+	req, err := c.getInvoiceNinjaRequest(ctx, "POST", "/bank_transactions", bankTx)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Idempotency-Key", idempotencyKey(tx.ID))
+
+	var res struct {
+		Data InvoiceNinjaBankTX `json:"data"`
+	}
+	if err := c.submitWrite(req, &res); err != nil {
+		return "", err
+	}
+	if res.Data.TransactionReference != bankTx.TransactionReference {
+		c.referenceUnstored.Store(true)
+		if !c.appendTxID() {
+			warnNoReference.Do(func() {
+				slog.Warn("InvoiceNinja did not store the transaction reference, so existing transactions " +
+					"can only be matched by date, amount and description, since appendTxIDToDescription is false")
+			})
+			return res.Data.ID, nil
+		}
+		warnNoReference.Do(func() {
+			slog.Info("InvoiceNinja did not store the transaction reference, " +
+				"so descriptions are suffixed with the Mercury ID instead")
+		})
+		// Created before that was known, so add the suffix it was created without. The transaction
+		// exists either way, so a failure must not have it created again.
+		if !mercuryIDSuffix.MatchString(bankTx.Description) {
+			if err := c.updateInvoiceNinjaTransaction(ctx, acct, tx, res.Data.ID); err != nil {
+				slog.Warn("Error adding the Mercury ID to the description of the created transaction",
+					"id", tx.ID, "invoice_ninja_id", res.Data.ID, "error", err)
+			}
+		}
+	}
+	return res.Data.ID, nil
+}
+
+func (c *Client) updateInvoiceNinjaTransaction(ctx context.Context, acct *MercuryAccount, tx *MercuryTransaction, id string) error {
+	slog.Debug("Updating bank transaction in InvoiceNinja", "id", id,
+		"amount", tx.Amount, "description", tx.BankDescription, "status", tx.Status)
+
+	bankTx := c.newInvoiceNinjaBankTX(acct, tx)
+	currencyID, err := invoiceNinjaCurrencyID(c.config, tx)
+	if err != nil {
+		return err
+	}
+	bankTx.CurrencyID = currencyID
+	if c.config.DryRun {
+		slog.Info("Dry run: would update bank transaction", "id", id, "transaction", bankTx)
+		return nil
+	}
+
+	req, err := c.getInvoiceNinjaRequest(ctx, "PUT", "/bank_transactions/"+url.PathEscape(id), bankTx)
+	if err != nil {
+		return err
+	}
+	return c.submitWrite(req, nil)
+}
+
+// deleteInvoiceNinjaTransaction treats an already deleted transaction as success
+func (c *Client) deleteInvoiceNinjaTransaction(ctx context.Context, id string) error {
+	slog.Debug("Deleting bank transaction in InvoiceNinja", "id", id)
+	if c.config.DryRun {
+		slog.Info("Dry run: would delete bank transaction", "id", id)
+		return nil
+	}
+
+	req, err := c.getInvoiceNinjaRequest(ctx, "DELETE", "/bank_transactions/"+url.PathEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	err = c.submitWrite(req, nil)
+	if errors.Is(err, errNotFound) {
+		slog.Debug("Bank transaction was already deleted in InvoiceNinja", "id", id)
+		return nil
+	}
+	return err
+}
+
+var warnNoReference sync.Once
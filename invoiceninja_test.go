@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFetchBankIntegrationsPages(t *testing.T) {
+	pages := [][]map[string]string{
+		{{"id": "bi-1", "provider_name": "Chase"}, {"id": "bi-2", "provider_name": "Wise"}},
+		{{"id": "bi-3", "provider_name": "Mercury"}},
+	}
+	config := testConfig(t, nil)
+	c := newTestClient(t, config, map[string]http.HandlerFunc{
+		"GET /invoiceninja/bank_integrations": func(w http.ResponseWriter, r *http.Request) {
+			page, err := strconv.Atoi(r.URL.Query().Get("page"))
+			if err != nil || page < 1 || page > len(pages) {
+				t.Errorf("unexpected page: %q", r.URL.Query().Get("page"))
+				http.NotFound(w, r)
+				return
+			}
+			writeJSON(t, w, http.StatusOK, map[string]any{
+				"data": pages[page-1],
+				"meta": map[string]any{"pagination": map[string]int{"current_page": page, "total_pages": len(pages)}},
+			})
+		},
+	})
+
+	if err := c.fetchBankIntegrations(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	id, err := accountBankIntegrationID(config, &MercuryAccount{ID: "acct-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "bi-3" {
+		t.Errorf("bank integration = %q, want bi-3", id)
+	}
+}
+
+func TestMercuryTxID(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	appendTxID := true
+	c := &Client{config: &Config{AppendTxIDToDescription: &appendTxID}}
+	tests := []struct {
+		tx   *InvoiceNinjaBankTX
+		want string
+	}{
+		{&InvoiceNinjaBankTX{TransactionReference: "tx-1", Description: "Coffee [mercury:tx-2]"}, "tx-1"},
+		{&InvoiceNinjaBankTX{Description: "Coffee [mercury:tx-2]"}, "tx-2"},
+		{&InvoiceNinjaBankTX{Description: "Coffee [mercury:tx-2] "}, "tx-2"},
+		{&InvoiceNinjaBankTX{Description: c.description(&MercuryTransaction{ID: "tx-3", BankDescription: long})}, "tx-3"},
+		{&InvoiceNinjaBankTX{Description: "[mercury:tx-2] Coffee"}, ""},
+		{&InvoiceNinjaBankTX{Description: "Coffee"}, ""},
+	}
+	for _, tt := range tests {
+		if got := mercuryTxID(tt.tx); got != tt.want {
+			t.Errorf("mercuryTxID(%+v) = %q, want %q", tt.tx, got, tt.want)
+		}
+	}
+}
+
+// The fixture is a bank transaction as returned by an InvoiceNinja version
+// that doesn't store the transaction reference
+func TestMercuryTxIDWithoutReference(t *testing.T) {
+	data, err := os.ReadFile("testdata/invoiceninja_bank_transaction.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res struct {
+		Data InvoiceNinjaBankTX `json:"data"`
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Data.TransactionReference != "" {
+		t.Fatalf("fixture has a transaction reference: %q", res.Data.TransactionReference)
+	}
+	if got, want := mercuryTxID(&res.Data), "7a1c2f3e-0000-4000-8000-000000000001"; got != want {
+		t.Errorf("mercuryTxID = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// lockDataDir isn't supported on this platform, so concurrent instances aren't prevented
+func lockDataDir(dataDir string) (*os.File, error) {
+	slog.Warn("Not locking the data directory on this platform", "dir", dataDir)
+	return nil, nil
+}
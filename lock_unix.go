@@ -0,0 +1,32 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockDataDir takes an exclusive lock on the data directory, so that a second instance
+// sharing it can't sync the same transactions. The lock is released when the returned
+// file is closed or the process exits, even on a crash, so it never goes stale.
+func lockDataDir(dataDir string) (*os.File, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating data directory: %v", err)
+	}
+	path := filepath.Join(dataDir, "sync.lock")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock file: %v", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("another instance is already syncing with the data directory %s", dataDir)
+		}
+		return nil, fmt.Errorf("error locking %s: %v", path, err)
+	}
+	return f, nil
+}
@@ -2,339 +2,538 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
-	"math"
-	"net/http"
+	"maps"
+	"math/rand/v2"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
 	"time"
 
-	rh "github.com/hashicorp/go-retryablehttp"
+	"github.com/robfig/cron/v3"
+	"sigs.k8s.io/yaml"
 )
 
+// Build information, set with -ldflags "-X main.version=... -X main.commit=... -X main.date=..."
+var (
+	version = "dev"
+	commit  = "dev"
+	date    = "dev"
+)
+
+// AccountMapping maps a Mercury account to an InvoiceNinja bank provider,
+// as a list form of Config.AccountBankProviders
+type AccountMapping struct {
+	MercuryAccountID string `json:"mercuryAccountID"`
+	BankProvider     string `json:"bankProvider"`
+}
+
 type Config struct {
-	MercuryAPIKey     string `json:"mercuryAPIKey"`
-	InvoiceNinjaToken string `json:"invoiceNinjaToken"`
-	InvoiceNinjaURL   string `json:"invoiceNinjaURL"`
-	BankProvider      string `json:"invoiceNinjaBankProvider"`
-	SyncIntervalHours int    `json:"syncIntervalHours"`
-	SyncStartDaysAgo  int    `json:"syncStartDaysAgo"`
-	LogLevel          string `json:"logLevel"`
-
-	stateFilePath     string
-	bankIntegrationID string
-	mercuryAccounts   []*MercuryAccount
+	MercuryAPIKey           string            `json:"mercuryAPIKey"`
+	InvoiceNinjaToken       string            `json:"invoiceNinjaToken"`
+	InvoiceNinjaURL         string            `json:"invoiceNinjaURL"`
+	InvoiceNinjaCompanyKey  string            `json:"invoiceNinjaCompanyKey"`
+	BankProvider            string            `json:"invoiceNinjaBankProvider"`
+	AccountBankProviders    map[string]string `json:"accountBankProviders"`
+	AccountMappings         []AccountMapping  `json:"accountMappings"`
+	IncludeAccounts         []string          `json:"includeAccounts"`
+	ExcludeAccounts         []string          `json:"excludeAccounts"`
+	IncludeAccountIDs       []string          `json:"includeAccountIDs"` // Alias of IncludeAccounts
+	ExcludeAccountIDs       []string          `json:"excludeAccountIDs"` // Alias of ExcludeAccounts
+	SyncIntervalHours       int               `json:"syncIntervalHours"`
+	SyncInterval            string            `json:"syncInterval"`
+	SyncCron                string            `json:"syncCron"`
+	SyncJitterSeconds       int               `json:"syncJitterSeconds"`
+	SyncStartDaysAgo        int               `json:"syncStartDaysAgo"`
+	FetchOverlapHours       int               `json:"fetchOverlapHours"`
+	DedupRetentionDays      int               `json:"dedupRetentionDays"`
+	StateRetentionDays      int               `json:"stateRetentionDays"` // Alias of DedupRetentionDays
+	MaxStateEntries         int               `json:"maxStateEntries"`
+	LogLevel                string            `json:"logLevel"`
+	LogFormat               string            `json:"logFormat"`
+	MercuryPageSize         int               `json:"mercuryPageSize"`
+	MercuryTxStatuses       []string          `json:"mercuryTxStatuses"`
+	MercuryTxStatus         string            `json:"mercuryTransactionStatus"` // Comma-separated form of MercuryTxStatuses
+	CurrencyIDs             map[string]string `json:"currencyIDs"`
+	DateField               string            `json:"dateField"`
+	DescriptionTemplate     string            `json:"descriptionTemplate"`
+	AppendTxIDToDescription *bool             `json:"appendTxIDToDescription"` // Unset to append once the reference isn't stored
+	MinAbsAmount            float64           `json:"minAbsAmount"`
+	IncludeDescriptionRegex string            `json:"includeDescriptionRegex"`
+	ExcludeDescriptionRegex string            `json:"excludeDescriptionRegex"`
+	IncludeKinds            []string          `json:"includeKinds"`
+	ExcludeKinds            []string          `json:"excludeKinds"`
+	StateBackend            string            `json:"stateBackend"`
+	RemoteDedup             bool              `json:"remoteDedup"`
+	MaxRetries              int               `json:"maxRetries"`
+	MaxConcurrency          int               `json:"maxConcurrency"`
+	InvoiceNinjaConcurrency int               `json:"invoiceNinjaConcurrency"`
+	AccountRefreshEvery     int               `json:"accountRefreshEvery"`
+	HTTPRetryMax            int               `json:"httpRetryMax"`
+	HTTPRetryWaitMinSeconds int               `json:"httpRetryWaitMinSeconds"`
+	HTTPRetryWaitMaxSeconds int               `json:"httpRetryWaitMaxSeconds"`
+	HTTPTimeoutSeconds      int               `json:"httpTimeoutSeconds"`
+	HTTPDeadlineSeconds     int               `json:"httpDeadlineSeconds"`
+	HTTPProxyURL            string            `json:"httpProxyURL"`
+	ReconcileOnStartup      bool              `json:"reconcileOnStartup"`
+	HealthPort              int               `json:"healthPort"`
+	WebhookPort             int               `json:"webhookPort"`
+	MercuryWebhookSecret    string            `json:"mercuryWebhookSecret"`
+	TraceHTTP               bool              `json:"traceHTTP"`
+	RunOnce                 bool              `json:"runOnce"`
+	DryRun                  bool              `json:"dryRun"`
+
+	// TLS settings for self-hosted InvoiceNinja instances
+	InvoiceNinjaCACertPath         string `json:"invoiceNinjaCACertPath"`
+	InvoiceNinjaInsecureSkipVerify bool   `json:"invoiceNinjaInsecureSkipVerify"`
+
+	syncInterval        time.Duration
+	syncSchedule        cron.Schedule
+	backfillStart       time.Time
+	backfillEnd         time.Time
+	httpProxyURL        *url.URL
+	invoiceNinjaCAs     *x509.CertPool
+	descriptionTemplate *template.Template
+	includeDescription  *regexp.Regexp
+	excludeDescription  *regexp.Regexp
+	stateFilePath       string
+	stateDBPath         string
+	bankIntegrations    map[string]string // IDs by provider name
+	mercuryAccounts     []*MercuryAccount
 }
 
-type SyncState struct {
-	ProcessedTxIDs map[string]time.Time `json:"processed_tx_ids"`
+// Bounds on how far back transactions are fetched, so that a typo doesn't
+// fetch decades of them from Mercury
+const (
+	maxSyncStartDaysAgo = 365
+	maxBackfillDays     = 10 * 365
+)
+
+// isBackfill reports whether a one-off sync over a fixed date range was requested
+func isBackfill(config *Config) bool {
+	return !config.backfillStart.IsZero()
 }
 
-type MercuryAccount struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+// parseBackfillTime accepts RFC3339 times and YYYY-MM-DD dates,
+// where an end date includes the whole day
+func parseBackfillTime(s string, end bool) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
 }
 
-type MercuryTransaction struct {
-	ID              string    `json:"id"`
-	Amount          float64   `json:"amount"`
-	BankDescription string    `json:"bankDescription"`
-	PostedAt        time.Time `json:"postedAt"`
+// setBackfill validates the backfill range given on the command line, if any
+func setBackfill(config *Config, start, end string) error {
+	if start == "" && end == "" {
+		return nil
+	}
+	if start == "" || end == "" {
+		return errors.New("both -backfill-start (-from) and -backfill-end (-to) must be set")
+	}
+	var err error
+	if config.backfillStart, err = parseBackfillTime(start, false); err != nil {
+		return fmt.Errorf("invalid backfill start: %v", err)
+	}
+	if config.backfillEnd, err = parseBackfillTime(end, true); err != nil {
+		return fmt.Errorf("invalid backfill end: %v", err)
+	}
+	if !config.backfillStart.Before(config.backfillEnd) {
+		return fmt.Errorf("backfill start %s is not before its end %s", start, end)
+	}
+	if days := config.backfillEnd.Sub(config.backfillStart).Hours() / 24; days > maxBackfillDays {
+		return fmt.Errorf("backfill range of %.0f days is longer than the maximum of %d days", days, maxBackfillDays)
+	}
+	config.RunOnce = true
+	return nil
 }
 
-type InvoiceNinjaBankTX struct {
-	Amount            float64 `json:"amount"`
-	Date              string  `json:"date"`
-	Description       string  `json:"description"`
-	BankIntegrationID string  `json:"bank_integration_id"`
-	BaseType          string  `json:"base_type"`
+// applyEnvConfig overrides config fields with the environment variables that are set
+func applyEnvConfig(config *Config) error {
+	for _, v := range []struct {
+		name  string
+		field *string
+	}{
+		{"MERCURY_API_KEY", &config.MercuryAPIKey},
+		{"MERCURY_WEBHOOK_SECRET", &config.MercuryWebhookSecret},
+		{"INVOICENINJA_TOKEN", &config.InvoiceNinjaToken},
+		{"INVOICENINJA_URL", &config.InvoiceNinjaURL},
+		{"INVOICE_NINJA_TOKEN", &config.InvoiceNinjaToken},
+		{"INVOICE_NINJA_URL", &config.InvoiceNinjaURL},
+		{"BANK_PROVIDER", &config.BankProvider},
+		{"INVOICE_NINJA_BANK_PROVIDER", &config.BankProvider},
+		{"SYNC_INTERVAL", &config.SyncInterval},
+		{"SYNC_CRON", &config.SyncCron},
+		{"LOG_LEVEL", &config.LogLevel},
+		{"LOG_FORMAT", &config.LogFormat},
+		{"STATE_BACKEND", &config.StateBackend},
+	} {
+		if value := os.Getenv(v.name); value != "" {
+			*v.field = value
+		}
+	}
+
+	for _, v := range []struct {
+		name  string
+		field *int
+	}{
+		{"SYNC_INTERVAL_HOURS", &config.SyncIntervalHours},
+		{"SYNC_START_DAYS_AGO", &config.SyncStartDaysAgo},
+		{"HEALTH_PORT", &config.HealthPort},
+	} {
+		if value := os.Getenv(v.name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", v.name, err)
+			}
+			*v.field = n
+		}
+	}
+	return nil
 }
 
-type BankIntegration struct {
-	ID           string `json:"id"`
-	ProviderName string `json:"provider_name"`
+// unmarshalConfig parses the config file as JSON or YAML depending on its extension,
+// trying both for other extensions. YAML is converted to JSON first, so the same tags apply.
+func unmarshalConfig(path string, data []byte, config *Config) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return json.Unmarshal(data, config)
+	case ".yaml", ".yml":
+		return yaml.Unmarshal(data, config)
+	}
+	if err := json.Unmarshal(data, config); err == nil {
+		return nil
+	}
+	return yaml.Unmarshal(data, config)
 }
 
 func loadConfig(configPath, dataDir, invoiceNinjaURL string) (*Config, error) {
 	config := &Config{
-		SyncIntervalHours: 1,
-		SyncStartDaysAgo:  7, // Typical time for bank transactions is 3–5 days
-		LogLevel:          "info",
-		BankProvider:      "Mercury",
-		stateFilePath:     filepath.Join(dataDir, "sync_state.json"),
+		SyncIntervalHours:       1,
+		SyncStartDaysAgo:        7, // Typical time for bank transactions is 3–5 days
+		LogLevel:                "info",
+		LogFormat:               "text",
+		MercuryPageSize:         500,
+		MercuryTxStatuses:       []string{"sent"},
+		CurrencyIDs:             maps.Clone(defaultCurrencyIDs), // Merged with the file's
+		DateField:               "postedAt",
+		MaxStateEntries:         10000,
+		MaxRetries:              5,
+		MaxConcurrency:          4,
+		InvoiceNinjaConcurrency: 1,
+		AccountRefreshEvery:     1,
+		HTTPRetryMax:            5,
+		HTTPRetryWaitMinSeconds: 1,
+		HTTPRetryWaitMaxSeconds: 30,
+		HTTPTimeoutSeconds:      30,
+		HTTPDeadlineSeconds:     120,
+		ReconcileOnStartup:      true,
+		BankProvider:            "Mercury",
+		StateBackend:            "file",
+		stateFilePath:           filepath.Join(dataDir, "sync_state.json"),
+		stateDBPath:             filepath.Join(dataDir, "sync_state.db"),
+	}
+
+	// Environment variables override the file, unless CONFIG_PRECEDENCE is "file",
+	// in which case they only fill in the settings the file leaves out
+	precedence := os.Getenv("CONFIG_PRECEDENCE")
+	switch precedence {
+	case "", "env":
+	case "file":
+		if err := applyEnvConfig(config); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid CONFIG_PRECEDENCE, expected env or file: %s", precedence)
 	}
 
+	// The config file is optional when everything required comes from the environment
 	configData, err := os.ReadFile(configPath)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return nil, fmt.Errorf("error reading config file: %v", err)
 	}
+	if err == nil {
+		if err := unmarshalConfig(configPath, configData, config); err != nil {
+			return nil, fmt.Errorf("error parsing config file: %v", err)
+		}
+	}
 
-	if err := json.Unmarshal(configData, config); err != nil {
-		return nil, fmt.Errorf("error parsing config file: %v", err)
+	if precedence != "file" {
+		if err := applyEnvConfig(config); err != nil {
+			return nil, err
+		}
 	}
 
+	// Report every invalid setting at once rather than one per restart
+	var errs []error
 	if config.MercuryAPIKey == "" {
-		return nil, fmt.Errorf("missing Mercury API key")
+		errs = append(errs, fmt.Errorf("missing Mercury API key"))
 	}
 	if config.InvoiceNinjaToken == "" {
-		return nil, fmt.Errorf("missing InvoiceNinja token")
+		errs = append(errs, fmt.Errorf("missing InvoiceNinja token"))
 	}
 
 	if config.InvoiceNinjaURL == "" {
 		config.InvoiceNinjaURL = invoiceNinjaURL
 	}
 	if _, err := url.ParseRequestURI(config.InvoiceNinjaURL); err != nil {
-		return nil, fmt.Errorf("invalid InvoiceNinja URL: %v", err)
+		errs = append(errs, fmt.Errorf("invalid InvoiceNinja URL: %v", err))
+	}
+	if config.InvoiceNinjaCACertPath != "" {
+		if pem, err := os.ReadFile(config.InvoiceNinjaCACertPath); err != nil {
+			errs = append(errs, fmt.Errorf("error reading InvoiceNinja CA certificate: %v", err))
+		} else {
+			// Trust the system CAs as well, in case the instance moves behind a public certificate
+			if config.invoiceNinjaCAs, err = x509.SystemCertPool(); err != nil {
+				config.invoiceNinjaCAs = x509.NewCertPool()
+			}
+			if !config.invoiceNinjaCAs.AppendCertsFromPEM(pem) {
+				errs = append(errs, fmt.Errorf("no certificates found in %s", config.InvoiceNinjaCACertPath))
+			}
+		}
 	}
 
-	return config, nil
-}
-
-func loadState(stateFilePath string) (*SyncState, error) {
-	state := &SyncState{
-		ProcessedTxIDs: make(map[string]time.Time),
+	// SyncInterval allows sub-hour intervals and takes precedence over SyncIntervalHours
+	if config.SyncInterval == "" && config.SyncCron == "" && config.SyncIntervalHours < 1 {
+		errs = append(errs, fmt.Errorf("sync interval hours must be at least 1: %d", config.SyncIntervalHours))
+	}
+	config.syncInterval = time.Duration(config.SyncIntervalHours) * time.Hour
+	if config.SyncInterval != "" {
+		interval, err := time.ParseDuration(config.SyncInterval)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("invalid sync interval: %v", err))
+		case interval < time.Minute:
+			errs = append(errs, fmt.Errorf("sync interval must be at least 1m: %s", config.SyncInterval))
+		default:
+			config.syncInterval = interval
+		}
 	}
-
-	if _, err := os.Stat(stateFilePath); os.IsNotExist(err) {
-		slog.Debug("No state file found, using default state")
-		return state, nil
+	// SyncCron takes precedence over both, and readiness allows for its longest gap
+	if config.SyncCron != "" {
+		if schedule, err := cron.ParseStandard(config.SyncCron); err != nil {
+			errs = append(errs, fmt.Errorf("invalid sync cron expression: %v", err))
+		} else {
+			config.syncSchedule = schedule
+			config.syncInterval = longestCronGap(schedule)
+		}
 	}
 
-	data, err := os.ReadFile(stateFilePath)
-	if err != nil {
-		return nil, fmt.Errorf("error reading state file: %v", err)
+	if config.SyncStartDaysAgo < 1 || config.SyncStartDaysAgo > maxSyncStartDaysAgo {
+		errs = append(errs, fmt.Errorf("sync start days ago must be between 1 and %d, use a backfill for older transactions: %d",
+			maxSyncStartDaysAgo, config.SyncStartDaysAgo))
 	}
 
-	if err := json.Unmarshal(data, state); err != nil {
-		return nil, fmt.Errorf("error parsing state file: %v", err)
+	// Processed transactions must be kept for as long as they can still be fetched
+	if config.DedupRetentionDays == 0 {
+		config.DedupRetentionDays = config.StateRetentionDays
 	}
-
-	slog.Debug("Loaded state", "processed_tx_count", len(state.ProcessedTxIDs))
-	return state, nil
-}
-
-func saveState(stateFilePath string, state *SyncState) error {
-	data, err := json.Marshal(state)
-	if err != nil {
-		return fmt.Errorf("error serializing state: %v", err)
+	if config.DedupRetentionDays == 0 {
+		config.DedupRetentionDays = max(config.SyncStartDaysAgo, 7)
 	}
-
-	dir := filepath.Dir(stateFilePath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("error creating state directory: %v", err)
+	if config.DedupRetentionDays < config.SyncStartDaysAgo {
+		errs = append(errs, fmt.Errorf("dedup retention of %d days is shorter than the sync window of %d days, "+
+			"which would re-create transactions: increase dedupRetentionDays", config.DedupRetentionDays, config.SyncStartDaysAgo))
 	}
 
-	if err := os.WriteFile(stateFilePath, data, 0644); err != nil {
-		return fmt.Errorf("error writing state file: %v", err)
+	// Transactions can take days to post, so by default the whole window is fetched every time
+	if config.FetchOverlapHours == 0 {
+		config.FetchOverlapHours = config.SyncStartDaysAgo * 24
+	}
+	if config.FetchOverlapHours < 0 {
+		errs = append(errs, fmt.Errorf("invalid fetch overlap: %d", config.FetchOverlapHours))
+	}
+	if config.MaxStateEntries <= 0 {
+		errs = append(errs, fmt.Errorf("invalid max state entries: %d", config.MaxStateEntries))
 	}
 
-	return nil
-}
+	if config.SyncJitterSeconds < 0 {
+		errs = append(errs, fmt.Errorf("invalid sync jitter: %d", config.SyncJitterSeconds))
+	}
 
-var retryClient = rh.NewClient()
+	config.IncludeAccounts = append(config.IncludeAccounts, config.IncludeAccountIDs...)
+	config.ExcludeAccounts = append(config.ExcludeAccounts, config.ExcludeAccountIDs...)
 
-func submitRequest(req *rh.Request, res any) error {
-	resp, err := retryClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("error submitting request: %s %s: %v", req.Method, req.URL, err)
+	if config.BankProvider == "" {
+		errs = append(errs, errors.New("missing InvoiceNinja bank provider"))
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("error submitting request: %s %s: %d %s",
-			req.Method, req.URL, resp.StatusCode, string(body))
+	for _, m := range config.AccountMappings {
+		if m.MercuryAccountID == "" || m.BankProvider == "" {
+			errs = append(errs, fmt.Errorf("incomplete account mapping: %+v", m))
+			continue
+		}
+		if config.AccountBankProviders == nil {
+			config.AccountBankProviders = make(map[string]string)
+		}
+		config.AccountBankProviders[m.MercuryAccountID] = m.BankProvider
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("error reading response body: %v", err)
+	switch strings.ToLower(config.LogLevel) {
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		errs = append(errs, fmt.Errorf("invalid log level: %s", config.LogLevel))
 	}
-	slog.Debug("API response", "method", req.Method, "url", req.URL,
-		"status", resp.StatusCode, "body", string(body))
-
-	if err := json.Unmarshal(body, res); err != nil {
-		return fmt.Errorf("error parsing JSON response: %s %s: %s %v",
-			req.Method, req.URL, string(body), err)
+	if format := strings.ToLower(config.LogFormat); format != "text" && format != "json" {
+		errs = append(errs, fmt.Errorf("invalid log format: %s", config.LogFormat))
 	}
-	return nil
-}
 
-func getRequest(method string, url string, headers map[string]string, body any) (*rh.Request, error) {
-	if body != nil {
-		b, err := json.Marshal(body)
-		if err != nil {
-			return nil, fmt.Errorf("error marshaling body: %s %s: %s %v", method, url, string(b), err)
+	if config.MercuryPageSize <= 0 {
+		errs = append(errs, fmt.Errorf("invalid Mercury page size: %d", config.MercuryPageSize))
+	}
+	if config.MercuryTxStatus != "" {
+		config.MercuryTxStatuses = nil
+		for _, status := range strings.Split(config.MercuryTxStatus, ",") {
+			config.MercuryTxStatuses = append(config.MercuryTxStatuses, strings.TrimSpace(status))
 		}
-		body = b
 	}
-	req, err := rh.NewRequest(method, url, body)
-	if err != nil {
-		return nil, fmt.Errorf("error creating request: %s %s: %v", method, url, err)
+	if len(config.MercuryTxStatuses) == 0 {
+		errs = append(errs, fmt.Errorf("missing Mercury transaction statuses"))
 	}
-	for k, v := range headers {
-		req.Header.Set(k, v)
+	for _, status := range config.MercuryTxStatuses {
+		if status != "pending" && status != "sent" {
+			errs = append(errs, fmt.Errorf("invalid Mercury transaction status: %s", status))
+		}
 	}
-	if body != nil {
-		req.Header.Set("Content-Type", "application/json")
+	if config.DescriptionTemplate != "" {
+		tmpl, err := template.New("description").Parse(config.DescriptionTemplate)
+		if err == nil {
+			// Catch misspelled fields now rather than on every transaction
+			err = tmpl.Execute(io.Discard, &MercuryTransaction{})
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid description template: %v", err))
+		} else {
+			config.descriptionTemplate = tmpl
+		}
 	}
-	return req, nil
-}
 
-func getMercuryRequest(config *Config, method string, url string, body any) (*rh.Request, error) {
-	headers := map[string]string{
-		"Authorization": "Bearer " + config.MercuryAPIKey,
+	for _, v := range []struct {
+		pattern string
+		re      **regexp.Regexp
+	}{
+		{config.IncludeDescriptionRegex, &config.includeDescription},
+		{config.ExcludeDescriptionRegex, &config.excludeDescription},
+	} {
+		if v.pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(v.pattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid description regex: %v", err))
+			continue
+		}
+		*v.re = re
 	}
-	return getRequest(method, "https://api.mercury.com/api/v1"+url, headers, body)
-}
-
-func fetchMercuryAccounts(config *Config) error {
-	slog.Debug("Fetching Mercury accounts")
 
-	req, err := getMercuryRequest(config, "GET", "/accounts", nil)
-	if err != nil {
-		return err
+	if config.MinAbsAmount < 0 {
+		errs = append(errs, fmt.Errorf("invalid minimum amount: %v", config.MinAbsAmount))
 	}
-	var res struct {
-		Accounts []*MercuryAccount `json:"accounts"`
+	switch config.DateField {
+	case "postedAt", "createdAt", "estimatedDeliveryDate":
+	default:
+		errs = append(errs, fmt.Errorf("invalid date field: %s", config.DateField))
 	}
-	if err = submitRequest(req, &res); err != nil {
-		return err
+	if config.MaxRetries <= 0 {
+		errs = append(errs, fmt.Errorf("invalid max retries: %d", config.MaxRetries))
 	}
-	config.mercuryAccounts = res.Accounts
-	return nil
-}
-
-func fetchMercuryTransactions(config *Config, acct *MercuryAccount) ([]*MercuryTransaction, error) {
-	start := time.Now().AddDate(0, 0, -config.SyncStartDaysAgo).UTC().Format(time.RFC3339)
-	slog.Debug("Fetching Mercury transactions", "account", acct.Name, "since", start)
-
-	url := fmt.Sprintf("/account/%s/transactions?status=sent&start=%s", acct.ID, start)
-	req, err := getMercuryRequest(config, "GET", url, nil)
-	if err != nil {
-		return nil, err
+	if config.MaxConcurrency <= 0 {
+		errs = append(errs, fmt.Errorf("invalid max concurrency: %d", config.MaxConcurrency))
 	}
-	var res struct {
-		Transactions []*MercuryTransaction `json:"transactions"`
+	if config.InvoiceNinjaConcurrency <= 0 {
+		errs = append(errs, fmt.Errorf("invalid InvoiceNinja concurrency: %d", config.InvoiceNinjaConcurrency))
 	}
-	if err = submitRequest(req, &res); err != nil {
-		return nil, err
+	if config.AccountRefreshEvery < 0 {
+		errs = append(errs, fmt.Errorf("invalid account refresh interval: %d", config.AccountRefreshEvery))
 	}
-	return res.Transactions, nil
-}
-
-func getInvoiceNinjaRequest(config *Config, method string, url string, body any) (*rh.Request, error) {
-	headers := map[string]string{
-		"X-API-Token":      config.InvoiceNinjaToken,
-		"X-Requested-With": "XMLHttpRequest",
+	if config.HTTPRetryMax < 0 {
+		errs = append(errs, fmt.Errorf("invalid HTTP retry max: %d", config.HTTPRetryMax))
 	}
-	return getRequest(method, config.InvoiceNinjaURL+"/api/v1"+url, headers, body)
-}
-
-func fetchBankIntegrationID(config *Config) error {
-	slog.Debug("Fetching InvoiceNinja bank integration")
-
-	req, err := getInvoiceNinjaRequest(config, "GET", "/bank_integrations", nil)
-	if err != nil {
-		return err
+	if config.HTTPRetryWaitMinSeconds < 0 {
+		errs = append(errs, fmt.Errorf("invalid HTTP retry min wait: %d", config.HTTPRetryWaitMinSeconds))
 	}
-	var res struct {
-		Integrations []*BankIntegration `json:"data"`
+	if config.HTTPRetryWaitMaxSeconds < config.HTTPRetryWaitMinSeconds {
+		errs = append(errs, fmt.Errorf("invalid HTTP retry max wait: %d", config.HTTPRetryWaitMaxSeconds))
 	}
-	if err = submitRequest(req, &res); err != nil {
-		return err
+	if config.HTTPTimeoutSeconds < 0 {
+		errs = append(errs, fmt.Errorf("invalid HTTP timeout: %d", config.HTTPTimeoutSeconds))
 	}
-
-	for _, ig := range res.Integrations {
-		if ig.ProviderName == config.BankProvider {
-			slog.Debug("Found bank integration", "provider", config.BankProvider, "id", ig.ID)
-			config.bankIntegrationID = ig.ID
-			return nil
+	if config.HTTPDeadlineSeconds < 0 {
+		errs = append(errs, fmt.Errorf("invalid HTTP deadline: %d", config.HTTPDeadlineSeconds))
+	}
+	if config.HTTPProxyURL != "" {
+		proxyURL, err := url.Parse(config.HTTPProxyURL)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("invalid HTTP proxy URL: %v", err))
+		case proxyURL.Scheme != "http" && proxyURL.Scheme != "https" && proxyURL.Scheme != "socks5":
+			errs = append(errs, fmt.Errorf("unsupported HTTP proxy scheme: %s", proxyURL.Scheme))
+		default:
+			config.httpProxyURL = proxyURL
 		}
 	}
-	return fmt.Errorf("no bank integration found for provider: %s", config.BankProvider)
-}
-
-func createInvoiceNinjaTransaction(config *Config, tx *MercuryTransaction) error {
-	slog.Debug("Creating bank transaction in InvoiceNinja",
-		"amount", tx.Amount, "description", tx.BankDescription)
-
-	baseType := "DEBIT"
-	if tx.Amount > 0 {
-		baseType = "CREDIT"
+	if config.HealthPort < 0 || config.HealthPort > 65535 {
+		errs = append(errs, fmt.Errorf("invalid health port: %d", config.HealthPort))
 	}
-
-	req, err := getInvoiceNinjaRequest(config, "POST", "/bank_transactions", &InvoiceNinjaBankTX{
-		Amount:            math.Abs(tx.Amount),
-		Date:              tx.PostedAt.Format("2006-01-02"),
-		Description:       tx.BankDescription,
-		BankIntegrationID: config.bankIntegrationID,
-		BaseType:          baseType,
-	})
-	if err != nil {
-		return err
+	if config.WebhookPort < 0 || config.WebhookPort > 65535 {
+		errs = append(errs, fmt.Errorf("invalid webhook port: %d", config.WebhookPort))
+	}
+	if config.WebhookPort > 0 && config.MercuryWebhookSecret == "" {
+		errs = append(errs, errors.New("mercuryWebhookSecret is required to receive webhooks"))
+	}
+	if config.StateBackend != "file" && config.StateBackend != "sqlite" {
+		errs = append(errs, fmt.Errorf("invalid state backend: %s", config.StateBackend))
 	}
 
-	return submitRequest(req, &struct {
-		Data InvoiceNinjaBankTX `json:"data"`
-	}{})
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return config, nil
 }
 
-func syncTransactions(config *Config, state *SyncState) error {
-	cutoffTime := time.Now().AddDate(0, 0, -config.SyncStartDaysAgo)
-
-	for id, timestamp := range state.ProcessedTxIDs {
-		if timestamp.Before(cutoffTime) {
-			delete(state.ProcessedTxIDs, id)
+// redactSecrets returns a slog ReplaceAttr function that masks the given secrets
+// and credential headers, so that debug logs can be shared safely
+func redactSecrets(secrets ...string) func(groups []string, a slog.Attr) slog.Attr {
+	var pairs []string
+	for _, secret := range secrets {
+		if secret != "" {
+			pairs = append(pairs, secret, "***")
 		}
 	}
+	replacer := strings.NewReplacer(pairs...)
 
-	totalProcessed := 0
-	for _, acct := range config.mercuryAccounts {
-		slog.Debug("Processing account", "name", acct.Name)
-
-		txs, err := fetchMercuryTransactions(config, acct)
-		if err != nil {
-			slog.Error("Error fetching transactions", "account", acct.Name, "error", err)
-			continue
+	return func(groups []string, a slog.Attr) slog.Attr {
+		if isSecretHeader(a.Key) {
+			return slog.String(a.Key, "***")
 		}
-		if len(txs) == 0 {
-			continue
-		}
-		slog.Debug("Processing transactions", "account", acct.Name, "count", len(txs))
-
-		processed := 0
-		for _, tx := range txs {
-			if _, ok := state.ProcessedTxIDs[tx.ID]; ok {
-				slog.Debug("Skipping already processed transaction", "id", tx.ID)
-				continue
-			}
-
-			if err := createInvoiceNinjaTransaction(config, tx); err != nil {
-				return err
-			} else {
-				state.ProcessedTxIDs[tx.ID] = time.Now()
-				totalProcessed++
-			}
-			processed++
+		if len(pairs) == 0 {
+			return a
 		}
-		if processed > 0 {
-			slog.Info("Account sync completed", "account", acct.Name, "transactions", processed)
+		// Only stringify values that contain a secret, to keep the others structured
+		s := a.Value.Resolve().String()
+		if redacted := replacer.Replace(s); redacted != s {
+			return slog.String(a.Key, redacted)
 		}
+		return a
 	}
-
-	slog.Debug("Sync completed", "transactions", totalProcessed)
-	return nil
 }
 
-func setupLog(logLevel string) {
+func setupLog(logLevel, logFormat string, secrets ...string) {
 	level := slog.LevelInfo
 	switch strings.ToLower(logLevel) {
 	case "debug":
@@ -347,55 +546,255 @@ func setupLog(logLevel string) {
 		level = slog.LevelError
 	}
 
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: level,
-	}))
-	slog.SetDefault(logger)
+	opts := &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redactSecrets(secrets...),
+	}
+	var handler slog.Handler = slog.NewTextHandler(os.Stdout, opts)
+	if strings.ToLower(logFormat) == "json" {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// longestCronGap returns the longest time between runs of the schedule over the next week,
+// or over its next dozen runs if that's longer, so that monthly schedules are measured too
+func longestCronGap(schedule cron.Schedule) time.Duration {
+	const minGaps = 12
+	var gap time.Duration
+	start := time.Now()
+	prev := schedule.Next(start)
+	for gaps := 0; !prev.IsZero() && (gaps < minGaps || prev.Before(start.AddDate(0, 0, 7))); gaps++ {
+		next := schedule.Next(prev)
+		if next.IsZero() {
+			break
+		}
+		gap = max(gap, next.Sub(prev))
+		prev = next
+	}
+	return gap
+}
+
+// waitForNextSync blocks until the interval since the last sync has passed, or the next
+// scheduled run, give or take a random jitter, until a manual sync is triggered,
+// or until the context is cancelled. It returns early with a reloaded config, if any.
+func waitForNextSync(ctx context.Context, config *Config, lastSync time.Time, manual <-chan os.Signal, reloads <-chan *Config) *Config {
+	next := lastSync.Add(config.syncInterval)
+	if config.syncSchedule != nil {
+		next = config.syncSchedule.Next(time.Now())
+	}
+	if config.SyncJitterSeconds > 0 {
+		jitter := time.Duration(config.SyncJitterSeconds) * time.Second
+		next = next.Add(rand.N(2*jitter+1) - jitter)
+	}
+
+	slog.Debug("Waiting for next sync", "at", next)
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	case <-manual:
+		slog.Info("manual sync triggered via SIGHUP")
+	case reloaded := <-reloads:
+		return reloaded
+	}
+	return nil
 }
 
-func setupHttpClient() {
-	retryClient.RetryMax = 5
-	if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
-		retryClient.Logger = nil
+// refreshAccounts picks up Mercury accounts and bank integrations that changed since
+// they were last fetched, keeping the previous ones if that fails
+func refreshAccounts(ctx context.Context, c *Client) {
+	syncing.Lock()
+	defer syncing.Unlock()
+
+	slog.Debug("Refreshing Mercury accounts and bank integrations")
+	if err := c.fetchBankIntegrations(ctx); err != nil {
+		slog.Error("Error refreshing bank integrations", "error", err)
+		return
+	}
+	if err := c.fetchMercuryAccounts(ctx); err != nil {
+		slog.Error("Error refreshing Mercury accounts", "error", err)
 	}
 }
 
+// preflight checks the credentials and URL of both APIs before the first sync,
+// reporting every one that is bad
+func preflight(ctx context.Context, c *Client) error {
+	return errors.Join(
+		preflightError("Mercury", c.mercuryURL, "mercuryAPIKey", c.checkMercury(ctx)),
+		preflightError("InvoiceNinja", c.invoiceNinjaURL, "invoiceNinjaToken", c.checkCompany(ctx)),
+	)
+}
+
+// preflightError points out the setting that is the likely cause of the error
+func preflightError(api, url, credential string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errAuth):
+		return fmt.Errorf("%s rejected the credentials, check %s: %w", api, credential, err)
+	case errors.Is(err, errNotFound):
+		return fmt.Errorf("%s API not found at %s, check the URL: %w", api, url, err)
+	}
+	return fmt.Errorf("error connecting to %s at %s: %w", api, url, err)
+}
+
 func main() {
 	configPath := flag.String("c", "/config.json", "Path to config file")
 	dataDir := flag.String("d", "/data", "Directory for storing state")
 	invoiceNinjaURL := flag.String("i", "", "InvoiceNinja URL")
+	var dryRun bool
+	flag.BoolVar(&dryRun, "n", false, "Log transactions instead of creating them in InvoiceNinja")
+	flag.BoolVar(&dryRun, "dry-run", false, "Same as -n")
+	once := flag.Bool("once", false, "Run a single sync and exit")
+	var backfillStart, backfillEnd string
+	flag.StringVar(&backfillStart, "backfill-start", "", "Sync once from this date (YYYY-MM-DD or RFC3339) instead of syncStartDaysAgo")
+	flag.StringVar(&backfillStart, "from", "", "Same as -backfill-start")
+	flag.StringVar(&backfillEnd, "backfill-end", "", "Sync once until this date (YYYY-MM-DD, inclusive, or RFC3339)")
+	flag.StringVar(&backfillEnd, "to", "", "Same as -backfill-end")
+	printVersion := flag.Bool("version", false, "Print the version and exit")
 	flag.Parse()
 
+	if *printVersion {
+		fmt.Printf("%s (commit %s, built %s)\n", version, commit, date)
+		return
+	}
+
 	config, err := loadConfig(*configPath, *dataDir, *invoiceNinjaURL)
 	if err != nil {
 		log.Fatalf("Error loading configuration: %v", err)
 	}
+	if err = setBackfill(config, backfillStart, backfillEnd); err != nil {
+		log.Fatalf("Error in backfill range: %v", err)
+	}
+	config.DryRun = config.DryRun || dryRun
+	config.RunOnce = config.RunOnce || *once
+
+	setupLog(config.LogLevel, config.LogFormat, config.MercuryAPIKey, config.InvoiceNinjaToken, config.MercuryWebhookSecret)
+	slog.Info("Starting", "version", version, "commit", commit, "date", date)
+	// Summarize the effective settings in one line, leaving out the credentials,
+	// before anything they may be the cause of fails
+	slog.Info("Configuration", "invoice_ninja_url", config.InvoiceNinjaURL, "bank_provider", config.BankProvider,
+		"interval", config.syncInterval, "cron", config.SyncCron, "sync_start_days_ago", config.SyncStartDaysAgo,
+		"log_level", config.LogLevel, "dry_run", config.DryRun)
+
+	lock, err := lockDataDir(*dataDir)
+	if err != nil {
+		log.Fatalf("Error locking data directory: %v", err)
+	}
+	defer lock.Close()
+	client := newClient(config)
+	if config.DryRun {
+		slog.Warn("Dry run: no transactions will be created, updated or deleted in InvoiceNinja")
+	}
 
-	setupLog(config.LogLevel)
-	setupHttpClient()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// Handled from the start, since SIGHUP would otherwise kill the process without
+	// saving the state. One sent during startup syncs again after the first sync, and -once ignores it.
+	manualSync := make(chan os.Signal, 1)
+	signal.Notify(manualSync, syscall.SIGHUP)
 
-	state, err := loadState(config.stateFilePath)
+	health.setSyncInterval(config.syncInterval)
+	if config.HealthPort > 0 {
+		startHealthServer(ctx, config)
+	}
+
+	store, err := newStateStore(config)
+	if err != nil {
+		log.Fatalf("Error opening state store: %v", err)
+	}
+	state, err := store.Load()
 	if err != nil {
 		log.Fatalf("Error loading state: %v", err)
 	}
 
-	if err = fetchBankIntegrationID(config); err != nil {
-		log.Fatalf("Error fetching bank integration ID: %v", err)
+	if err = preflight(ctx, client); err != nil {
+		log.Fatalf("Error in preflight check: %v", err)
+	}
+
+	if err = client.fetchBankIntegrations(ctx); err != nil {
+		log.Fatalf("Error fetching bank integrations: %v", err)
 	}
 
-	if err = fetchMercuryAccounts(config); err != nil {
+	if err = client.fetchMercuryAccounts(ctx); err != nil {
 		log.Fatalf("Error fetching Mercury accounts: %v", err)
 	}
+	health.setReady()
+	slog.Info("Fetched Mercury accounts", "accounts", len(config.mercuryAccounts))
 
-	for {
-		if err := syncTransactions(config, state); err != nil {
-			slog.Error("Error in sync", "error", err)
-		} else if err := saveState(config.stateFilePath, state); err != nil {
-			slog.Error("Error saving state", "error", err)
+	if config.ReconcileOnStartup {
+		if err := reconcileState(ctx, client, state); err != nil {
+			slog.Error("Error reconciling state with InvoiceNinja", "error", err)
+			syncErrorsTotal.WithLabelValues(stageDedup).Inc()
 		}
+	}
+
+	if config.RunOnce {
+		syncErr := syncTransactions(ctx, client, state)
+		if err := saveState(config, store, state); err != nil {
+			log.Fatalf("Error saving state: %v", err)
+		}
+		if syncErr != nil {
+			log.Fatalf("Error in sync: %v", syncErr)
+		}
+		return
+	}
+
+	if config.WebhookPort > 0 {
+		startWebhookServer(ctx, client, state, store)
+	}
+
+	// Without a config file, there's nothing to reload
+	var reloads <-chan *Config
+	if _, err := os.Stat(*configPath); err == nil {
+		if reloads, err = watchConfig(ctx, *configPath, *dataDir, *invoiceNinjaURL); err != nil {
+			slog.Error("Error watching config file, changes require a restart", "error", err)
+		}
+	}
+
+	for cycle := 0; ctx.Err() == nil; cycle++ {
+		if cycle > 0 && config.AccountRefreshEvery > 0 && cycle%config.AccountRefreshEvery == 0 {
+			refreshAccounts(ctx, client)
+		}
+		lastSync := time.Now()
+		err := syncTransactions(ctx, client, state)
+		if err != nil && ctx.Err() != nil {
+			slog.Info("Sync aborted by shutdown")
+			break
+		}
+		if errors.Is(err, errSyncSkipped) {
+			// Nothing ran, so there's nothing to record or save
+			slog.Warn("previous sync still running, skipping tick")
+		} else {
+			health.recordSync(err)
+			if err != nil {
+				slog.Error("Error in sync", "error", err)
+			}
+			// Save even after a failed sync, since transactions created before the error
+			// must not be re-created on the next run
+			if err := saveState(config, store, state); err != nil {
+				slog.Error("Error saving state", "error", err)
+			}
+			if isFatal(err) {
+				log.Fatalf("Error in sync, not retrying: %v", err)
+			}
+		}
+
+		// Keep waiting after a reload, on the schedule of the new config
+		for {
+			reloaded := waitForNextSync(ctx, config, lastSync, manualSync, reloads)
+			if reloaded == nil {
+				break
+			}
+			reloadConfig(ctx, client, reloaded, dryRun)
+		}
+	}
 
-		nextSync := time.Now().Add(time.Duration(config.SyncIntervalHours) * time.Hour)
-		slog.Debug("Waiting for next sync", "next_sync", nextSync.Format(time.RFC3339))
-		time.Sleep(time.Until(nextSync))
+	// Persist whatever the aborted sync managed to process, so it's not re-created on restart
+	slog.Info("Shutting down")
+	if err := saveState(config, store, state); err != nil {
+		log.Fatalf("Error saving state: %v", err)
 	}
 }
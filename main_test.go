@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+func TestRedactSecrets(t *testing.T) {
+	const key = "secret-mercury-key"
+	for _, format := range []string{"text", "json"} {
+		var buf bytes.Buffer
+		opts := &slog.HandlerOptions{ReplaceAttr: redactSecrets(key, "")}
+		var handler slog.Handler = slog.NewTextHandler(&buf, opts)
+		if format == "json" {
+			handler = slog.NewJSONHandler(&buf, opts)
+		}
+		logger := slog.New(handler)
+
+		logger.Info("Using key "+key, "key", key)
+		logger.Error("Error in request", "error", errors.New("GET /accounts?token="+key+": 401"))
+		logger.Info("API request", "headers", http.Header{"Authorization": {"Bearer " + key}})
+		logger.Info("API request", "Authorization", "Bearer something-else")
+		logger.WithGroup("request").Info("Sent", "url", "https://api.mercury.com/?key="+key)
+		logger.Info("Unrelated", "count", 3)
+
+		out := buf.String()
+		if strings.Contains(out, key) {
+			t.Errorf("%s: key was logged:\n%s", format, out)
+		}
+		if strings.Contains(out, "something-else") {
+			t.Errorf("%s: Authorization header was logged:\n%s", format, out)
+		}
+		if !strings.Contains(out, "count") || !strings.Contains(out, "3") {
+			t.Errorf("%s: other attributes were dropped:\n%s", format, out)
+		}
+	}
+}
+
+func TestLoadConfigSyncIntervalHours(t *testing.T) {
+	tests := []struct {
+		settings map[string]any
+		valid    bool
+	}{
+		{map[string]any{"syncIntervalHours": 1}, true},
+		{map[string]any{"syncIntervalHours": 24}, true},
+		{map[string]any{"syncIntervalHours": 0}, false},
+		{map[string]any{"syncIntervalHours": -1}, false},
+		// Ignored when a finer interval or a schedule is set
+		{map[string]any{"syncIntervalHours": 0, "syncInterval": "15m"}, true},
+		{map[string]any{"syncIntervalHours": -1, "syncCron": "0 * * * *"}, true},
+	}
+	for _, tt := range tests {
+		_, err := loadTestConfig(t, tt.settings)
+		if (err == nil) != tt.valid {
+			t.Errorf("%v: error = %v, want valid %v", tt.settings, err, tt.valid)
+		}
+		if err != nil && !strings.Contains(err.Error(), "sync interval hours") {
+			t.Errorf("%v: error = %v, want it to name the setting", tt.settings, err)
+		}
+	}
+}
+
+func TestLoadConfigSyncStartDaysAgoBounds(t *testing.T) {
+	for days, valid := range map[int]bool{0: false, 1: true, maxSyncStartDaysAgo: true, maxSyncStartDaysAgo + 1: false} {
+		_, err := loadTestConfig(t, map[string]any{"syncStartDaysAgo": days})
+		if (err == nil) != valid {
+			t.Errorf("syncStartDaysAgo %d: error = %v, want valid %v", days, err, valid)
+		}
+	}
+}
+
+func TestSetBackfillBounds(t *testing.T) {
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	maxEnd := start.AddDate(0, 0, maxBackfillDays)
+	tests := []struct {
+		name       string
+		start, end string
+		valid      bool
+	}{
+		{"maximum range", start.Format(time.RFC3339), maxEnd.Format(time.RFC3339), true},
+		{"over maximum range", start.Format(time.RFC3339), maxEnd.Add(time.Second).Format(time.RFC3339), false},
+		// The end date includes its whole day
+		{"maximum range of dates", start.Format("2006-01-02"), maxEnd.AddDate(0, 0, -1).Format("2006-01-02"), true},
+		{"over maximum range of dates", start.Format("2006-01-02"), maxEnd.Format("2006-01-02"), false},
+		{"single day", "2024-03-01", "2024-03-01", true},
+		{"end before start", "2024-03-02", "2024-03-01", false},
+		{"missing end", "2024-03-01", "", false},
+	}
+	for _, tt := range tests {
+		config := &Config{}
+		err := setBackfill(config, tt.start, tt.end)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: error = %v, want valid %v", tt.name, err, tt.valid)
+		}
+		if err == nil && !config.RunOnce {
+			t.Errorf("%s: backfill doesn't run once", tt.name)
+		}
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		precedence string
+		settings   map[string]any
+		want       string
+	}{
+		{"", map[string]any{"logLevel": "warn"}, "debug"},
+		{"env", map[string]any{"logLevel": "warn"}, "debug"},
+		{"file", map[string]any{"logLevel": "warn"}, "warn"},
+		{"file", nil, "debug"},
+	}
+	for _, tt := range tests {
+		t.Setenv("LOG_LEVEL", "debug")
+		t.Setenv("CONFIG_PRECEDENCE", tt.precedence)
+		config := testConfig(t, tt.settings)
+		if config.LogLevel != tt.want {
+			t.Errorf("CONFIG_PRECEDENCE=%q, file %v: log level = %s, want %s", tt.precedence, tt.settings, config.LogLevel, tt.want)
+		}
+	}
+
+	t.Setenv("CONFIG_PRECEDENCE", "files")
+	if _, err := loadTestConfig(t, nil); err == nil {
+		t.Error("loaded config with an invalid CONFIG_PRECEDENCE")
+	}
+}
+
+func TestLongestCronGap(t *testing.T) {
+	tests := []struct {
+		expr string
+		want time.Duration
+	}{
+		{"*/15 * * * *", 15 * time.Minute},
+		{"0 9 * * 1-5", 72 * time.Hour},
+		// Months differ in length
+		{"0 0 1 * *", 31 * 24 * time.Hour},
+		{"0 0 1 1,7 *", 184 * 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		schedule, err := cron.ParseStandard(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Daylight saving time can shift a gap by an hour
+		if got := longestCronGap(schedule); got < tt.want-time.Hour || got > tt.want+time.Hour {
+			t.Errorf("longestCronGap(%q) = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+
+	config := testConfig(t, map[string]any{"syncCron": "0 0 1 * *"})
+	if config.syncInterval < 28*24*time.Hour {
+		t.Errorf("sync interval of a monthly schedule = %v", config.syncInterval)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	rh "github.com/hashicorp/go-retryablehttp"
+)
+
+type MercuryAccount struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	// InvoiceNinja bank integration the account's transactions are synced to
+	bankIntegrationID string
+}
+
+type MercuryTransaction struct {
+	ID              string  `json:"id"`
+	Amount          float64 `json:"amount"`
+	BankDescription string  `json:"bankDescription"`
+	// Name of the other party, usually more readable than the bank description
+	CounterpartyName string    `json:"counterpartyName"`
+	PostedAt         time.Time `json:"postedAt"`
+	CreatedAt        time.Time `json:"createdAt"`
+	Status           string    `json:"status"`
+	// Such as "externalTransfer", "internalTransfer" or "debitCardTransaction"
+	Kind string `json:"kind"`
+	// Note added to the transaction in Mercury
+	Note string `json:"note"`
+	// Only set for transactions that haven't arrived yet
+	EstimatedDeliveryDate time.Time `json:"estimatedDeliveryDate"`
+	// ISO 4217 code, absent for USD accounts
+	Currency string `json:"currency"`
+}
+
+func (c *Client) getMercuryRequest(ctx context.Context, method string, url string, body any) (*rh.Request, error) {
+	headers := map[string]string{
+		"Authorization": "Bearer " + c.config.MercuryAPIKey,
+	}
+	return getRequest(ctx, method, c.mercuryURL+url, headers, body)
+}
+
+// checkMercury verifies that the Mercury API key is valid
+func (c *Client) checkMercury(ctx context.Context) error {
+	req, err := c.getMercuryRequest(ctx, "GET", "/accounts", nil)
+	if err != nil {
+		return err
+	}
+	return c.submitRequest(req, nil)
+}
+
+func (c *Client) fetchMercuryAccounts(ctx context.Context) error {
+	slog.Debug("Fetching Mercury accounts")
+
+	req, err := c.getMercuryRequest(ctx, "GET", "/accounts", nil)
+	if err != nil {
+		return err
+	}
+	var res struct {
+		Accounts []*MercuryAccount `json:"accounts"`
+	}
+	if err = c.submitRequest(req, &res); err != nil {
+		return err
+	}
+
+	// On refreshes, only log what changed since the previous fetch
+	previous := c.config.mercuryAccounts
+	refresh := previous != nil
+	var accounts []*MercuryAccount
+	for _, acct := range res.Accounts {
+		if skip, reason := skipsAccount(c.config, acct); skip {
+			if !refresh {
+				slog.Info("Skipping account", "name", acct.Name, "id", acct.ID, "reason", reason)
+			}
+			continue
+		}
+		if acct.bankIntegrationID, err = accountBankIntegrationID(c.config, acct); err != nil {
+			return fmt.Errorf("error mapping account %s: %v", acct.Name, err)
+		}
+		if refresh && !slices.ContainsFunc(previous, func(prev *MercuryAccount) bool {
+			return prev.ID == acct.ID
+		}) {
+			slog.Info("Found new Mercury account", "name", acct.Name, "id", acct.ID)
+		}
+		accounts = append(accounts, acct)
+	}
+	for ref := range c.config.AccountBankProviders {
+		if !refresh && !slices.ContainsFunc(res.Accounts, func(acct *MercuryAccount) bool {
+			return acct.ID == ref || acct.Name == ref
+		}) {
+			slog.Warn("No Mercury account found for bank provider mapping", "account", ref)
+		}
+	}
+	c.config.mercuryAccounts = accounts
+	return nil
+}
+
+func matchesAccount(refs []string, acct *MercuryAccount) bool {
+	return slices.Contains(refs, acct.ID) || slices.Contains(refs, acct.Name)
+}
+
+// skipsAccount applies the includeAccounts allowlist, if any, or else the excludeAccounts denylist,
+// and returns why the account is skipped
+func skipsAccount(config *Config, acct *MercuryAccount) (bool, string) {
+	if len(config.IncludeAccounts) > 0 {
+		return !matchesAccount(config.IncludeAccounts, acct), "not in includeAccounts"
+	}
+	return matchesAccount(config.ExcludeAccounts, acct), "in excludeAccounts"
+}
+
+// fetchMercuryTransactions returns the transactions of the account since the given time,
+// and until the other given time unless it's zero
+func (c *Client) fetchMercuryTransactions(ctx context.Context, acct *MercuryAccount, since, until time.Time) ([]*MercuryTransaction, error) {
+	start := since.UTC().Format(time.RFC3339)
+	var end string
+	if !until.IsZero() {
+		end = until.UTC().Format(time.RFC3339)
+	}
+	slog.Debug("Fetching Mercury transactions", "account", acct.Name, "since", start, "until", end)
+
+	// Also fetch reversed transactions, so the ones synced earlier can be removed.
+	// The API filters on a single status, so each is fetched separately.
+	statuses := append([]string{"cancelled", "failed"}, c.config.MercuryTxStatuses...)
+	var txs []*MercuryTransaction
+	pages := 0
+	for _, status := range statuses {
+		fetched := 0
+		for {
+			url := fmt.Sprintf("/account/%s/transactions?%s", acct.ID,
+				mercuryTransactionsQuery(status, start, end, c.config.MercuryPageSize, fetched))
+			req, err := c.getMercuryRequest(ctx, "GET", url, nil)
+			if err != nil {
+				return nil, err
+			}
+			var res struct {
+				Total        int                   `json:"total"`
+				Transactions []*MercuryTransaction `json:"transactions"`
+			}
+			if err = c.submitRequest(req, &res); err != nil {
+				return nil, err
+			}
+			txs = append(txs, res.Transactions...)
+			fetched += len(res.Transactions)
+			pages++
+
+			// An empty page means the API has nothing more to give, even if total says otherwise
+			if len(res.Transactions) == 0 || fetched >= res.Total {
+				break
+			}
+		}
+	}
+	slog.Debug("Fetched Mercury transactions", "account", acct.Name, "count", len(txs), "pages", pages)
+	return txs, nil
+}
+
+// fetchMercuryTransaction returns a single transaction of the account
+func (c *Client) fetchMercuryTransaction(ctx context.Context, acct *MercuryAccount, id string) (*MercuryTransaction, error) {
+	slog.Debug("Fetching Mercury transaction", "account", acct.Name, "id", id)
+
+	path := fmt.Sprintf("/account/%s/transaction/%s", acct.ID, url.PathEscape(id))
+	req, err := c.getMercuryRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	var tx MercuryTransaction
+	if err = c.submitRequest(req, &tx); err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+// date returns the given date field of the transaction, falling back to
+// the posting and then the creation date when it isn't set
+func (tx *MercuryTransaction) date(field string) time.Time {
+	dates := map[string]time.Time{
+		"postedAt":              tx.PostedAt,
+		"createdAt":             tx.CreatedAt,
+		"estimatedDeliveryDate": tx.EstimatedDeliveryDate,
+	}
+	for _, d := range []time.Time{dates[field], tx.PostedAt, tx.CreatedAt} {
+		if !d.IsZero() {
+			return d
+		}
+	}
+	return time.Time{}
+}
+
+// isReversed reports whether the transaction didn't go through,
+// so it must not be synced and should be removed if it was
+func isReversed(tx *MercuryTransaction) bool {
+	return tx.Status == "cancelled" || tx.Status == "failed"
+}
+
+func mercuryTransactionsQuery(status, start, end string, limit, offset int) string {
+	query := url.Values{
+		"status": {status},
+		"start":  {start},
+		"limit":  {strconv.Itoa(limit)},
+		"offset": {strconv.Itoa(offset)},
+	}
+	if end != "" {
+		query.Set("end", end)
+	}
+	return query.Encode()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// mercuryTransactionsHandler serves the sent transactions with the given IDs a page at a time,
+// reporting total as their number, and records the query of each request for them
+func mercuryTransactionsHandler(t *testing.T, ids []string, total int, queries *[]url.Values) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		txs := []map[string]any{}
+		if slices.Contains(query["status"], "sent") {
+			*queries = append(*queries, query)
+			offset, _ := strconv.Atoi(query.Get("offset"))
+			limit, _ := strconv.Atoi(query.Get("limit"))
+			for _, id := range ids[min(offset, len(ids)):min(offset+limit, len(ids))] {
+				txs = append(txs, map[string]any{"id": id, "amount": -10, "status": "sent"})
+			}
+		}
+		writeJSON(t, w, http.StatusOK, map[string]any{"total": total, "transactions": txs})
+	}
+}
+
+func TestFetchMercuryTransactionsPages(t *testing.T) {
+	tests := []struct {
+		name  string
+		ids   []string
+		total int
+		pages int
+	}{
+		{"until total", []string{"tx-1", "tx-2", "tx-3"}, 3, 2},
+		{"until empty page", []string{"tx-1", "tx-2"}, 10, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queries []url.Values
+			c := newTestClient(t, testConfig(t, map[string]any{"mercuryPageSize": 2}), map[string]http.HandlerFunc{
+				"GET /mercury/account/acct-1/transactions": mercuryTransactionsHandler(t, tt.ids, tt.total, &queries),
+			})
+
+			since := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+			txs, err := c.fetchMercuryTransactions(context.Background(), &MercuryAccount{ID: "acct-1"}, since, time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(txs) != len(tt.ids) {
+				t.Errorf("got %d transactions, want %d", len(txs), len(tt.ids))
+			}
+			if len(queries) != tt.pages {
+				t.Fatalf("got %d requests, want %d", len(queries), tt.pages)
+			}
+			for i, query := range queries {
+				if got := query.Get("start"); got != "2024-03-01T00:00:00Z" {
+					t.Errorf("page %d: start = %q", i+1, got)
+				}
+				if got := query["status"]; !slices.Equal(got, queries[0]["status"]) {
+					t.Errorf("page %d: status = %q, want %q", i+1, got, queries[0]["status"])
+				}
+				if got, want := query.Get("offset"), fmt.Sprint(2*i); got != want {
+					t.Errorf("page %d: offset = %q, want %q", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMercuryTransactionsQuery(t *testing.T) {
+	query, err := url.ParseQuery(mercuryTransactionsQuery("sent", "2024-03-01T00:00:00Z", "", 500, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := url.Values{
+		"status": {"sent"},
+		"start":  {"2024-03-01T00:00:00Z"},
+		"limit":  {"500"},
+		"offset": {"1000"},
+	}
+	if query.Encode() != want.Encode() {
+		t.Errorf("query = %s, want %s", query.Encode(), want.Encode())
+	}
+
+	query, err = url.ParseQuery(mercuryTransactionsQuery("sent", "2024-03-01T00:00:00Z", "2024-04-01T00:00:00Z", 500, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := query.Get("end"); got != "2024-04-01T00:00:00Z" {
+		t.Errorf("end = %q", got)
+	}
+}
+
+func TestFetchMercuryTransactionsOneStatusPerRequest(t *testing.T) {
+	var statuses []string
+	c := newTestClient(t, testConfig(t, nil), map[string]http.HandlerFunc{
+		"GET /mercury/account/acct-1/transactions": func(w http.ResponseWriter, r *http.Request) {
+			query := r.URL.Query()["status"]
+			if len(query) != 1 {
+				t.Errorf("status = %q, want a single one", query)
+			}
+			statuses = append(statuses, query...)
+			writeJSON(t, w, http.StatusOK, map[string]any{
+				"total":        1,
+				"transactions": []map[string]any{{"id": "tx-" + query[0], "amount": -10, "status": query[0]}},
+			})
+		},
+	})
+
+	txs, err := c.fetchMercuryTransactions(context.Background(), &MercuryAccount{ID: "acct-1"}, time.Now(), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"cancelled", "failed", "sent"}; !slices.Equal(statuses, want) {
+		t.Errorf("statuses = %q, want %q", statuses, want)
+	}
+	if len(txs) != 3 {
+		t.Errorf("got %d transactions, want 3", len(txs))
+	}
+}
+
+func TestFetchMercuryTransactionsConfiguredStatuses(t *testing.T) {
+	tests := []struct {
+		settings map[string]any
+		want     []string
+	}{
+		{nil, []string{"cancelled", "failed", "sent"}},
+		{map[string]any{"mercuryTxStatuses": []string{"pending", "sent"}}, []string{"cancelled", "failed", "pending", "sent"}},
+		{map[string]any{"mercuryTransactionStatus": "pending, sent"}, []string{"cancelled", "failed", "pending", "sent"}},
+		{map[string]any{"mercuryTransactionStatus": "pending"}, []string{"cancelled", "failed", "pending"}},
+	}
+	for _, tt := range tests {
+		var statuses []string
+		c := newTestClient(t, testConfig(t, tt.settings), map[string]http.HandlerFunc{
+			"GET /mercury/account/acct-1/transactions": func(w http.ResponseWriter, r *http.Request) {
+				statuses = append(statuses, r.URL.Query()["status"]...)
+				writeJSON(t, w, http.StatusOK, map[string]any{"total": 0, "transactions": []any{}})
+			},
+		})
+		if _, err := c.fetchMercuryTransactions(context.Background(), &MercuryAccount{ID: "acct-1"}, time.Now(), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(statuses, tt.want) {
+			t.Errorf("%v: statuses = %q, want %q", tt.settings, statuses, tt.want)
+		}
+	}
+}
+
+func TestSkipsAccount(t *testing.T) {
+	checking := &MercuryAccount{ID: "acct-1", Name: "Checking"}
+	savings := &MercuryAccount{ID: "acct-2", Name: "Savings"}
+	tests := []struct {
+		name     string
+		settings map[string]any
+		skipped  []bool // of checking and savings
+	}{
+		{"no lists", nil, []bool{false, false}},
+		{"include by ID", map[string]any{"includeAccounts": []string{"acct-1"}}, []bool{false, true}},
+		{"include by name", map[string]any{"includeAccounts": []string{"Savings"}}, []bool{true, false}},
+		{"include alias", map[string]any{"includeAccountIDs": []string{"acct-2"}}, []bool{true, false}},
+		{"exclude by ID", map[string]any{"excludeAccounts": []string{"acct-1"}}, []bool{true, false}},
+		{"exclude by name", map[string]any{"excludeAccountIDs": []string{"Savings"}}, []bool{false, true}},
+		{"include takes precedence", map[string]any{
+			"includeAccounts": []string{"Checking"},
+			"excludeAccounts": []string{"Checking", "Savings"},
+		}, []bool{false, true}},
+	}
+	for _, tt := range tests {
+		config := testConfig(t, tt.settings)
+		for i, acct := range []*MercuryAccount{checking, savings} {
+			if skip, reason := skipsAccount(config, acct); skip != tt.skipped[i] {
+				t.Errorf("%s: skipsAccount(%s) = %v (%s), want %v", tt.name, acct.Name, skip, reason, tt.skipped[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	txCreatedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mercury_sync_transactions_created_total",
+		Help: "Bank transactions created in InvoiceNinja.",
+	})
+	txSkippedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mercury_sync_transactions_skipped_total",
+		Help: "Mercury transactions skipped, by whether they were already processed, already in InvoiceNinja or filtered out.",
+	}, []string{"reason"})
+	syncErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mercury_sync_errors_total",
+		Help: "Errors by the stage of the sync they occurred in.",
+	}, []string{"stage"})
+	lastSuccessTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mercury_sync_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful sync.",
+	})
+	syncDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mercury_sync_duration_seconds",
+		Help:    "Duration of syncs.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	})
+)
+
+// Stages for syncErrorsTotal
+const (
+	stageTransactions = "transactions"
+	stageDedup        = "dedup"
+	stageCreate       = "create"
+	stageUpdate       = "update"
+	stageDelete       = "delete"
+)
+
+// Reasons for txSkippedTotal
+const (
+	skipProcessed = "processed"
+	skipExists    = "exists"
+	skipFiltered  = "filtered"
+)
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchConfig sends the config loaded from the file whenever the file changes,
+// unless it's invalid. The directory is watched rather than the file,
+// since editors and Kubernetes ConfigMaps replace the file instead of writing to it.
+func watchConfig(ctx context.Context, configPath, dataDir, invoiceNinjaURL string) (<-chan *Config, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("error creating config watcher: %v", err)
+	}
+	if err := watcher.Add(filepath.Dir(configPath)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("error watching config directory: %v", err)
+	}
+
+	reloads := make(chan *Config)
+	go func() {
+		defer watcher.Close()
+		last, _ := os.ReadFile(configPath)
+		// Saving a file can take several events, so wait for them to settle
+		settled := time.NewTimer(time.Hour)
+		settled.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-watcher.Errors:
+				slog.Error("Error watching config file", "error", err)
+			case <-watcher.Events:
+				settled.Reset(time.Second)
+			case <-settled.C:
+				// Other files in the directory change too
+				data, err := os.ReadFile(configPath)
+				if err != nil || bytes.Equal(data, last) {
+					continue
+				}
+				last = data
+
+				config, err := loadConfig(configPath, dataDir, invoiceNinjaURL)
+				if err != nil {
+					slog.Error("Error reloading configuration, keeping the previous one", "error", err)
+					continue
+				}
+				select {
+				case reloads <- config:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return reloads, nil
+}
+
+// reloadConfig applies a reloaded config between syncs. The state backend, the ports
+// and the webhook secret only change on restart, and the accounts are fetched again
+// in case their filters or mappings changed.
+func reloadConfig(ctx context.Context, c *Client, reloaded *Config, dryRun bool) {
+	// Webhook-driven syncs may be using the config
+	syncing.Lock()
+	config := c.config
+	if reloaded.StateBackend != config.StateBackend || reloaded.HealthPort != config.HealthPort ||
+		reloaded.WebhookPort != config.WebhookPort || reloaded.MercuryWebhookSecret != config.MercuryWebhookSecret {
+		slog.Warn("Changes to stateBackend, healthPort and the webhook settings take effect after a restart")
+	}
+	reloaded.StateBackend = config.StateBackend
+	reloaded.HealthPort = config.HealthPort
+	reloaded.WebhookPort = config.WebhookPort
+	reloaded.MercuryWebhookSecret = config.MercuryWebhookSecret
+	reloaded.DryRun = reloaded.DryRun || dryRun
+	reloaded.bankIntegrations = config.bankIntegrations
+	reloaded.mercuryAccounts = config.mercuryAccounts
+	*config = *reloaded
+
+	setupLog(config.LogLevel, config.LogFormat, config.MercuryAPIKey, config.InvoiceNinjaToken, config.MercuryWebhookSecret)
+	// Only swap what the config shapes, since webhook goroutines read the rest of the client
+	// without the lock, and it keeps what was learned about InvoiceNinja
+	fresh := newClient(config)
+	c.http = fresh.http
+	c.invoiceNinjaHTTP = fresh.invoiceNinjaHTTP
+	c.invoiceNinjaWrites = fresh.invoiceNinjaWrites
+	c.invoiceNinjaURL = fresh.invoiceNinjaURL
+	health.setSyncInterval(config.syncInterval)
+	syncing.Unlock()
+
+	refreshAccounts(ctx, c)
+	slog.Info("Reloaded configuration")
+}
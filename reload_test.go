@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadConfigKeepsClient(t *testing.T) {
+	_, c := newFakeAPIs(t, nil)
+	c.referenceUnstored.Store(true)
+	config := c.config
+	store := &FileStateStore{path: filepath.Join(t.TempDir(), "sync_state.json")}
+	state := newSyncState()
+
+	// Like the save after a webhook-driven sync, which reads the config without the lock
+	saved := make(chan error)
+	go func() { saved <- saveState(c.config, store, state) }()
+	reloaded := testConfig(t, map[string]any{"maxRetries": 2})
+	// Refreshing the accounts fails right away, keeping the fetched ones
+	reloaded.InvoiceNinjaURL = "http://127.0.0.1:1"
+	reloadConfig(context.Background(), c, reloaded, false)
+	if err := <-saved; err != nil {
+		t.Fatal(err)
+	}
+
+	if c.config != config || config.MaxRetries != 2 {
+		t.Errorf("config = %+v, want the reloaded one in place", c.config)
+	}
+	if len(config.mercuryAccounts) != 1 {
+		t.Errorf("accounts = %+v, want the fetched ones kept", config.mercuryAccounts)
+	}
+	if !c.referenceUnstored.Load() {
+		t.Error("reload forgot that InvoiceNinja doesn't store the reference")
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+type SyncState struct {
+	ProcessedTxIDs map[string]*ProcessedTx `json:"processed_tx_ids"`
+	// Transactions that failed to sync, by the number of failed attempts
+	FailedTxIDs map[string]int `json:"failed_tx_attempts"`
+	// Transactions that exhausted their retries and are no longer attempted
+	DeadLetterTxIDs map[string]*DeadLetterTx `json:"dead_letter_tx_ids"`
+	// Newest creation time of the synced transactions, held back at the oldest pending one,
+	// by Mercury account ID
+	LastSyncedAt map[string]time.Time `json:"last_synced_at"`
+}
+
+type ProcessedTx struct {
+	ProcessedAt time.Time `json:"processed_at"`
+	// ID of the created InvoiceNinja transaction, empty if it already existed
+	InvoiceNinjaID string `json:"invoice_ninja_id,omitempty"`
+	// contentHash of the transaction when it was last synced
+	Hash string `json:"hash,omitempty"`
+}
+
+// UnmarshalJSON also accepts the bare timestamps stored by earlier versions
+func (p *ProcessedTx) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &p.ProcessedAt)
+	}
+	type processedTx ProcessedTx
+	return json.Unmarshal(data, (*processedTx)(p))
+}
+
+type DeadLetterTx struct {
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+func newSyncState() *SyncState {
+	return &SyncState{
+		ProcessedTxIDs:  make(map[string]*ProcessedTx),
+		FailedTxIDs:     make(map[string]int),
+		DeadLetterTxIDs: make(map[string]*DeadLetterTx),
+		LastSyncedAt:    make(map[string]time.Time),
+	}
+}
+
+// StateStore persists the sync state between runs
+type StateStore interface {
+	Load() (*SyncState, error)
+	Save(state *SyncState) error
+}
+
+func newStateStore(config *Config) (StateStore, error) {
+	switch config.StateBackend {
+	case "file":
+		return &FileStateStore{path: config.stateFilePath}, nil
+	case "sqlite":
+		return openSQLiteStateStore(config.stateDBPath)
+	}
+	return nil, fmt.Errorf("unknown state backend: %s", config.StateBackend)
+}
+
+// FileStateStore keeps the state in a single JSON file
+type FileStateStore struct {
+	path string
+}
+
+func (s *FileStateStore) Load() (*SyncState, error) {
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		slog.Debug("No state file found, using default state")
+		return newSyncState(), nil
+	}
+
+	state, err := readStateFile(s.path)
+	if err != nil {
+		// Fall back to the previous state rather than losing all dedup history
+		backup, backupErr := readStateFile(s.backupPath())
+		if backupErr != nil {
+			return nil, err
+		}
+		slog.Warn("Error loading state file, using its backup", "error", err, "backup", s.backupPath())
+		state = backup
+	}
+
+	slog.Debug("Loaded state", "processed_tx_count", len(state.ProcessedTxIDs),
+		"failed_tx_count", len(state.FailedTxIDs), "dead_letter_tx_count", len(state.DeadLetterTxIDs))
+	return state, nil
+}
+
+func (s *FileStateStore) backupPath() string {
+	return s.path + ".bak"
+}
+
+func readStateFile(path string) (*SyncState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file: %v", err)
+	}
+
+	state := newSyncState()
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("error parsing state file: %v", err)
+	}
+
+	if state.ProcessedTxIDs == nil {
+		state.ProcessedTxIDs = make(map[string]*ProcessedTx)
+	}
+	if state.FailedTxIDs == nil {
+		state.FailedTxIDs = make(map[string]int)
+	}
+	if state.DeadLetterTxIDs == nil {
+		state.DeadLetterTxIDs = make(map[string]*DeadLetterTx)
+	}
+	if state.LastSyncedAt == nil {
+		state.LastSyncedAt = make(map[string]time.Time)
+	}
+	// null entries decode to nil, which nothing else expects
+	maps.DeleteFunc(state.ProcessedTxIDs, func(_ string, p *ProcessedTx) bool { return p == nil })
+	maps.DeleteFunc(state.DeadLetterTxIDs, func(_ string, dl *DeadLetterTx) bool { return dl == nil })
+	return state, nil
+}
+
+func (s *FileStateStore) Save(state *SyncState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error serializing state: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("error creating state directory: %v", err)
+	}
+
+	// Keep the current state as a backup, unless it's the one that's corrupt
+	if current, err := os.ReadFile(s.path); err == nil && json.Valid(current) {
+		if err := writeFileAtomic(s.backupPath(), current); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic writes to a temporary file and renames it into place,
+// so a crash mid-write never leaves a truncated file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating temporary state file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing state file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing state file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing state file: %v", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("error setting state file permissions: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error replacing state file: %v", err)
+	}
+	// Also sync the directory so the rename itself survives a crash,
+	// where the filesystem supports it
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// SQLiteStateStore keeps the state in a SQLite database,
+// which survives partial writes and can live on shared storage
+type SQLiteStateStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStateStore(path string) (*SQLiteStateStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("error creating state directory: %v", err)
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening state database: %v", err)
+	}
+	for _, table := range []string{
+		`processed_transactions (tx_id TEXT PRIMARY KEY, processed_at TEXT NOT NULL)`,
+		`failed_attempts (tx_id TEXT PRIMARY KEY, attempts INTEGER NOT NULL)`,
+		`dead_letter_transactions (tx_id TEXT PRIMARY KEY, error TEXT NOT NULL, failed_at TEXT NOT NULL)`,
+		`account_sync_times (account_id TEXT PRIMARY KEY, last_synced_at TEXT NOT NULL)`,
+	} {
+		if _, err := db.Exec("CREATE TABLE IF NOT EXISTS " + table); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error creating state schema: %v", err)
+		}
+	}
+	// Columns added after their table was first released
+	for _, column := range []string{"invoice_ninja_id", "hash"} {
+		if err := addColumnIfMissing(db, "processed_transactions", column, "TEXT NOT NULL DEFAULT ''"); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &SQLiteStateStore{db: db}, nil
+}
+
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("error reading state schema: %v", err)
+	}
+	if count > 0 {
+		return nil
+	}
+	if _, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition); err != nil {
+		return fmt.Errorf("error migrating state schema: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStateStore) Load() (*SyncState, error) {
+	state := newSyncState()
+
+	err := s.query("SELECT tx_id, processed_at, invoice_ninja_id, hash FROM processed_transactions", func(rows *sql.Rows) error {
+		var id string
+		var processedAt sqliteTime
+		var p ProcessedTx
+		if err := rows.Scan(&id, &processedAt, &p.InvoiceNinjaID, &p.Hash); err != nil {
+			return err
+		}
+		p.ProcessedAt = time.Time(processedAt)
+		state.ProcessedTxIDs[id] = &p
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.query("SELECT tx_id, attempts FROM failed_attempts", func(rows *sql.Rows) error {
+		var id string
+		var attempts int
+		if err := rows.Scan(&id, &attempts); err != nil {
+			return err
+		}
+		state.FailedTxIDs[id] = attempts
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.query("SELECT tx_id, error, failed_at FROM dead_letter_transactions", func(rows *sql.Rows) error {
+		var id string
+		var dl DeadLetterTx
+		var failedAt sqliteTime
+		if err := rows.Scan(&id, &dl.Error, &failedAt); err != nil {
+			return err
+		}
+		dl.FailedAt = time.Time(failedAt)
+		state.DeadLetterTxIDs[id] = &dl
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.query("SELECT account_id, last_synced_at FROM account_sync_times", func(rows *sql.Rows) error {
+		var id string
+		var lastSyncedAt sqliteTime
+		if err := rows.Scan(&id, &lastSyncedAt); err != nil {
+			return err
+		}
+		state.LastSyncedAt[id] = time.Time(lastSyncedAt)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Debug("Loaded state", "processed_tx_count", len(state.ProcessedTxIDs),
+		"failed_tx_count", len(state.FailedTxIDs), "dead_letter_tx_count", len(state.DeadLetterTxIDs))
+	return state, nil
+}
+
+func (s *SQLiteStateStore) query(query string, scan func(rows *sql.Rows) error) error {
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return fmt.Errorf("error reading state database: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return fmt.Errorf("error reading state database: %v", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading state database: %v", err)
+	}
+	return nil
+}
+
+// Save replaces the stored rows with the given state in one transaction,
+// so entries pruned from memory are pruned from the database too
+func (s *SQLiteStateStore) Save(state *SyncState) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting state transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var processed, failed, deadLetter, syncTimes [][]any
+	for id, p := range state.ProcessedTxIDs {
+		processed = append(processed, []any{id, sqliteTime(p.ProcessedAt), p.InvoiceNinjaID, p.Hash})
+	}
+	for id, attempts := range state.FailedTxIDs {
+		failed = append(failed, []any{id, attempts})
+	}
+	for id, dl := range state.DeadLetterTxIDs {
+		deadLetter = append(deadLetter, []any{id, dl.Error, sqliteTime(dl.FailedAt)})
+	}
+	for id, t := range state.LastSyncedAt {
+		syncTimes = append(syncTimes, []any{id, sqliteTime(t)})
+	}
+
+	if err := replaceRows(tx, "processed_transactions (tx_id, processed_at, invoice_ninja_id, hash)", processed); err != nil {
+		return err
+	}
+	if err := replaceRows(tx, "failed_attempts (tx_id, attempts)", failed); err != nil {
+		return err
+	}
+	if err := replaceRows(tx, "dead_letter_transactions (tx_id, error, failed_at)", deadLetter); err != nil {
+		return err
+	}
+	if err := replaceRows(tx, "account_sync_times (account_id, last_synced_at)", syncTimes); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing state: %v", err)
+	}
+	return nil
+}
+
+// replaceRows clears the table and inserts the given rows into the listed columns
+func replaceRows(tx *sql.Tx, tableColumns string, rows [][]any) error {
+	table, columns, _ := strings.Cut(tableColumns, " ")
+	if _, err := tx.Exec("DELETE FROM " + table); err != nil {
+		return fmt.Errorf("error clearing state table %s: %v", table, err)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(rows[0])), ", ")
+	stmt, err := tx.Prepare("INSERT INTO " + table + " " + columns + " VALUES (" + placeholders + ")")
+	if err != nil {
+		return fmt.Errorf("error preparing state insert: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, row := range rows {
+		if _, err := stmt.Exec(row...); err != nil {
+			return fmt.Errorf("error writing state table %s: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// sqliteTime stores timestamps as RFC 3339 text
+type sqliteTime time.Time
+
+func (t sqliteTime) Value() (driver.Value, error) {
+	return time.Time(t).UTC().Format(time.RFC3339Nano), nil
+}
+
+func (t *sqliteTime) Scan(src any) error {
+	s, ok := src.(string)
+	if !ok {
+		return fmt.Errorf("unexpected timestamp type: %T", src)
+	}
+	ts, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return fmt.Errorf("error parsing timestamp: %v", err)
+	}
+	*t = sqliteTime(ts)
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStateStorePartialWrite(t *testing.T) {
+	dir := t.TempDir()
+	store := &FileStateStore{path: filepath.Join(dir, "sync_state.json")}
+	state := newSyncState()
+	state.ProcessedTxIDs["tx-1"] = &ProcessedTx{ProcessedAt: time.Now()}
+	if err := store.Save(state); err != nil {
+		t.Fatal(err)
+	}
+
+	// Such as when the process is killed halfway through writing the next state
+	partial := filepath.Join(dir, "sync_state.json.123456.tmp")
+	if err := os.WriteFile(partial, []byte(`{"processed_tx_ids": {"tx-1": {"proc`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.ProcessedTxIDs["tx-1"]; !ok {
+		t.Errorf("state = %+v, want tx-1 processed", loaded.ProcessedTxIDs)
+	}
+
+	state.ProcessedTxIDs["tx-2"] = &ProcessedTx{ProcessedAt: time.Now()}
+	if err := store.Save(state); err != nil {
+		t.Fatal(err)
+	}
+	tmps, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmps) != 1 || tmps[0] != partial {
+		t.Errorf("temporary files = %q, want only the partial one", tmps)
+	}
+	if loaded, err = store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.ProcessedTxIDs) != 2 {
+		t.Errorf("state = %+v, want tx-1 and tx-2 processed", loaded.ProcessedTxIDs)
+	}
+}
+
+func TestFileStateStoreLoadsBackupOfCorruptFile(t *testing.T) {
+	dir := t.TempDir()
+	store := &FileStateStore{path: filepath.Join(dir, "sync_state.json")}
+	backup := newSyncState()
+	backup.ProcessedTxIDs["tx-1"] = &ProcessedTx{ProcessedAt: time.Now()}
+	if err := writeFileAtomic(store.backupPath(), mustMarshal(t, backup)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(store.path, []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.ProcessedTxIDs["tx-1"]; !ok {
+		t.Errorf("state = %+v, want the backup's", state.ProcessedTxIDs)
+	}
+
+	// Without a valid backup, the corruption is reported rather than starting over
+	if err := os.WriteFile(store.backupPath(), []byte("{not json either"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(); err == nil {
+		t.Error("loaded a corrupt state file without a valid backup")
+	}
+}
+
+func mustMarshal(t *testing.T, v any) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestFileStateStoreRecoversFromCorruption(t *testing.T) {
+	dir := t.TempDir()
+	store := &FileStateStore{path: filepath.Join(dir, "sync_state.json")}
+	state := newSyncState()
+	for _, id := range []string{"tx-1", "tx-2"} {
+		state.ProcessedTxIDs[id] = &ProcessedTx{ProcessedAt: time.Now()}
+		if err := store.Save(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Truncate the state file, as a full disk or a crash without fsync could
+	data, err := os.ReadFile(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(store.path, data[:len(data)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovered.ProcessedTxIDs) != 1 {
+		t.Errorf("recovered state = %+v, want the previous one with tx-1", recovered.ProcessedTxIDs)
+	}
+
+	// The next save replaces the corrupt file, and keeps the valid backup rather than the corrupt one
+	recovered.ProcessedTxIDs["tx-3"] = &ProcessedTx{ProcessedAt: time.Now()}
+	if err := store.Save(recovered); err != nil {
+		t.Fatal(err)
+	}
+	if backup, err := readStateFile(store.backupPath()); err != nil || len(backup.ProcessedTxIDs) != 1 {
+		t.Errorf("backup = %+v, %v, want the state with tx-1", backup, err)
+	}
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.ProcessedTxIDs) != 2 {
+		t.Errorf("state = %+v, want tx-1 and tx-3 processed", loaded.ProcessedTxIDs)
+	}
+}
+
+func TestSaveStateSkippedInDryRun(t *testing.T) {
+	dir := t.TempDir()
+	store := &FileStateStore{path: filepath.Join(dir, "sync_state.json")}
+	state := newSyncState()
+	state.ProcessedTxIDs["tx-1"] = &ProcessedTx{ProcessedAt: time.Now()}
+
+	if err := saveState(&Config{DryRun: true}, store, state); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(store.path); !os.IsNotExist(err) {
+		t.Errorf("dry run saved the state: %v", err)
+	}
+	if err := saveState(&Config{}, store, state); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(store.path); err != nil {
+		t.Errorf("state wasn't saved: %v", err)
+	}
+}
+
+func TestFileStateStoreLoadsLegacyFormat(t *testing.T) {
+	store := &FileStateStore{path: filepath.Join(t.TempDir(), "sync_state.json")}
+	processedAt := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	// As written by versions that only kept the time each transaction was processed
+	legacy := `{"processed_tx_ids": {"tx-1": "` + processedAt.Format(time.RFC3339) + `", "tx-2": null},
+		"failed_tx_attempts": {"tx-3": 2}, "dead_letter_tx_ids": {"tx-4": null}}`
+	if err := os.WriteFile(store.path, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if synced := state.ProcessedTxIDs["tx-1"]; synced == nil || !synced.ProcessedAt.Equal(processedAt) {
+		t.Errorf("tx-1 = %+v, want processed at %s", synced, processedAt)
+	}
+	if _, ok := state.ProcessedTxIDs["tx-2"]; ok {
+		t.Error("null entry was kept")
+	}
+	if len(state.DeadLetterTxIDs) > 0 {
+		t.Errorf("dead-lettered = %v, want the null entry dropped", state.DeadLetterTxIDs)
+	}
+	if state.FailedTxIDs["tx-3"] != 2 || state.LastSyncedAt == nil {
+		t.Errorf("state = %+v", state)
+	}
+
+	// Saved in the current format
+	if err := store.Save(state); err != nil {
+		t.Fatal(err)
+	}
+	if state, err = store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if synced := state.ProcessedTxIDs["tx-1"]; synced == nil || !synced.ProcessedAt.Equal(processedAt) {
+		t.Errorf("tx-1 after saving = %+v, want processed at %s", synced, processedAt)
+	}
+}
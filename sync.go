@@ -0,0 +1,622 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"maps"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// InvoiceNinja may shorten long descriptions, so only their prefix is compared
+const dedupDescriptionLen = 100
+
+func dedupKey(tx *InvoiceNinjaBankTX) string {
+	desc := []rune(strings.TrimSpace(tx.Description))
+	if len(desc) > dedupDescriptionLen {
+		desc = desc[:dedupDescriptionLen]
+	}
+	return fmt.Sprintf("%s|%s|%.2f|%s", tx.Date, tx.BaseType, tx.Amount, string(desc))
+}
+
+// contentHash changes when a transaction changes in a way its InvoiceNinja transaction
+// must follow, such as a pending transaction posting with its final amount and date
+func contentHash(config *Config, tx *MercuryTransaction) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%.2f|%s|%s", tx.Amount, tx.date(config.DateField).Format("2006-01-02"), tx.Status)
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// syncWindowStart returns the start of the backfill range if there is one,
+// or else of the rolling sync window
+func syncWindowStart(config *Config) time.Time {
+	if isBackfill(config) {
+		return config.backfillStart
+	}
+	return time.Now().AddDate(0, 0, -config.SyncStartDaysAgo)
+}
+
+// remoteTransactions indexes the existing InvoiceNinja transactions for dedup
+type remoteTransactions struct {
+	// InvoiceNinja IDs by Mercury ID
+	refs map[string]string
+	// InvoiceNinja IDs of transactions created without a reference, by dedupKey,
+	// so that legitimately identical transactions are only skipped as many times as they exist
+	keys map[string][]string
+}
+
+func fetchRemoteTransactions(ctx context.Context, c *Client) (*remoteTransactions, error) {
+	since := syncWindowStart(c.config).Format("2006-01-02")
+	txs, err := c.fetchInvoiceNinjaTransactions(ctx, since)
+	if err != nil {
+		return nil, err
+	}
+	remote := &remoteTransactions{
+		refs: make(map[string]string),
+		keys: make(map[string][]string),
+	}
+	for _, tx := range txs {
+		c.noteReference(tx)
+		if id := mercuryTxID(tx); id != "" {
+			remote.refs[id] = tx.ID
+		} else {
+			key := dedupKey(tx)
+			remote.keys[key] = append(remote.keys[key], tx.ID)
+		}
+	}
+	slog.Debug("Fetched remote transactions for dedup", "transactions", len(txs), "with_reference", len(remote.refs))
+	return remote, nil
+}
+
+// take returns the ID of the transaction if it already exists in InvoiceNinja,
+// matching on the Mercury ID and falling back to date, amount and description
+func (r *remoteTransactions) take(tx *InvoiceNinjaBankTX) (string, bool) {
+	if id, ok := r.refs[tx.TransactionReference]; ok {
+		return id, true
+	}
+	key := dedupKey(tx)
+	if ids := r.keys[key]; len(ids) > 0 {
+		r.keys[key] = ids[1:]
+		return ids[0], true
+	}
+	return "", false
+}
+
+// reconcileState marks the transactions already created in InvoiceNinja as processed,
+// so that recovering from a lost state file doesn't re-create them
+func reconcileState(ctx context.Context, c *Client, state *SyncState) error {
+	since := syncWindowStart(c.config).Format("2006-01-02")
+	txs, err := c.fetchInvoiceNinjaTransactions(ctx, since)
+	if err != nil {
+		return err
+	}
+
+	seeded := 0
+	for _, tx := range txs {
+		c.noteReference(tx)
+		id := mercuryTxID(tx)
+		if id == "" {
+			continue
+		}
+		if _, ok := state.ProcessedTxIDs[id]; !ok {
+			state.ProcessedTxIDs[id] = &ProcessedTx{
+				ProcessedAt:    time.Now(),
+				InvoiceNinjaID: tx.ID,
+			}
+			seeded++
+		}
+	}
+	if seeded > 0 {
+		slog.Info("Reconciled state with InvoiceNinja", "transactions", seeded)
+	}
+	return nil
+}
+
+// syncRun tracks the progress of one sync across concurrently processed accounts
+type syncRun struct {
+	client *Client
+	config *Config
+	remote *remoteTransactions
+
+	// mu guards everything below, including the contents of state and remote
+	mu          sync.Mutex
+	state       *SyncState
+	processed   int
+	skipped     int
+	errs        []error
+	seen        map[string]bool
+	fetchFailed bool
+	// Accounts with transactions that failed to sync, whose last synced time isn't advanced,
+	// so that they're fetched again from the previous one
+	failedAccounts map[string]bool
+	// Processed transactions by account name
+	accountCounts map[string]int
+}
+
+// syncing guards the state and accounts, which webhook-driven syncs,
+// saves and refreshes change alongside the scheduled syncs
+var syncing sync.Mutex
+
+// scheduledSync guards against re-entering a scheduled sync that is still running.
+// It's separate from syncing, so that a webhook in flight delays the scheduled sync
+// rather than skipping it.
+var scheduledSync sync.Mutex
+
+// errSyncSkipped is returned by syncTransactions when the previous sync is still running
+var errSyncSkipped = errors.New("previous sync still running")
+
+// saveState saves the state once no sync is changing it, except in dry runs,
+// whose reconciling, pruning and failures must not carry over into a real run
+func saveState(config *Config, store StateStore, state *SyncState) error {
+	syncing.Lock()
+	defer syncing.Unlock()
+	if config.DryRun {
+		slog.Debug("Dry run: not saving state")
+		return nil
+	}
+	return store.Save(state)
+}
+
+// syncWebhookTransaction syncs a transaction that Mercury notified about
+// the same way as the ones fetched by syncTransactions
+func syncWebhookTransaction(ctx context.Context, c *Client, state *SyncState, txID string) error {
+	syncing.Lock()
+	defer syncing.Unlock()
+
+	config := c.config
+	// Webhooks don't say which account the transaction belongs to
+	for _, acct := range config.mercuryAccounts {
+		tx, err := c.fetchMercuryTransaction(ctx, acct, txID)
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err != nil {
+			syncErrorsTotal.WithLabelValues(stageTransactions).Inc()
+			return fmt.Errorf("error fetching transaction %s: %w", txID, err)
+		}
+		if !isReversed(tx) && !slices.Contains(config.MercuryTxStatuses, tx.Status) {
+			slog.Debug("Skipping webhook transaction with unsynced status", "id", tx.ID, "status", tx.Status)
+			return nil
+		}
+
+		run := &syncRun{
+			client: c,
+			config: config,
+			state:  state,
+			seen:   make(map[string]bool),
+
+			failedAccounts: make(map[string]bool),
+			accountCounts:  make(map[string]int),
+		}
+		// Failures are logged, and retried by the next sync like any other
+		_, _, err = run.processTransactions(ctx, acct, []*MercuryTransaction{tx})
+		return err
+	}
+	slog.Debug("Webhook transaction not found in synced accounts", "id", txID)
+	return nil
+}
+
+func syncTransactions(ctx context.Context, c *Client, state *SyncState) (err error) {
+	if !scheduledSync.TryLock() {
+		return errSyncSkipped
+	}
+	defer scheduledSync.Unlock()
+	syncing.Lock()
+	defer syncing.Unlock()
+	config := c.config
+
+	start := time.Now()
+	defer func() { syncDuration.Observe(time.Since(start).Seconds()) }()
+
+	cutoffTime := time.Now().AddDate(0, 0, -config.DedupRetentionDays)
+
+	for id, p := range state.ProcessedTxIDs {
+		if p.ProcessedAt.Before(cutoffTime) {
+			delete(state.ProcessedTxIDs, id)
+		}
+	}
+	for id, dl := range state.DeadLetterTxIDs {
+		if dl.FailedAt.Before(cutoffTime) {
+			delete(state.DeadLetterTxIDs, id)
+		}
+	}
+	// Also bound the state of high-volume accounts, dropping the oldest entries first,
+	// but never ones that can still be fetched, since they would be created again
+	if excess := len(state.ProcessedTxIDs) - config.MaxStateEntries; excess > 0 {
+		windowStart := syncWindowStart(config)
+		ids := slices.SortedFunc(maps.Keys(state.ProcessedTxIDs), func(a, b string) int {
+			return state.ProcessedTxIDs[a].ProcessedAt.Compare(state.ProcessedTxIDs[b].ProcessedAt)
+		})
+		pruned := 0
+		for _, id := range ids[:excess] {
+			if !state.ProcessedTxIDs[id].ProcessedAt.Before(windowStart) {
+				break
+			}
+			delete(state.ProcessedTxIDs, id)
+			pruned++
+		}
+		if pruned > 0 {
+			slog.Info("Pruned oldest processed transactions from state", "count", pruned)
+		}
+		if pruned < excess {
+			slog.Warn("More transactions processed within the sync window than maxStateEntries, keeping them to avoid duplicates",
+				"count", len(state.ProcessedTxIDs), "max_state_entries", config.MaxStateEntries)
+		}
+	}
+
+	run := &syncRun{
+		client: c,
+		config: config,
+		state:  state,
+		seen:   make(map[string]bool),
+
+		failedAccounts: make(map[string]bool),
+		accountCounts:  make(map[string]int),
+	}
+	defer func() {
+		status := &LastSyncStatus{
+			Time:      time.Now(),
+			Processed: run.processed,
+			Skipped:   run.skipped,
+			Failed:    len(run.errs),
+			Accounts:  run.accountCounts,
+		}
+		if err != nil {
+			status.Error = err.Error()
+		}
+		health.recordStatus(status)
+	}()
+	// A backfill reaches back past what the state remembers, so it checks the range for
+	// transactions created by earlier syncs whose dedup entries were pruned
+	if config.RemoteDedup || isBackfill(config) {
+		var err error
+		if run.remote, err = fetchRemoteTransactions(ctx, c); err != nil {
+			syncErrorsTotal.WithLabelValues(stageDedup).Inc()
+			return fmt.Errorf("error fetching InvoiceNinja transactions for dedup: %w", err)
+		}
+	}
+
+	var g errgroup.Group
+	g.SetLimit(config.MaxConcurrency)
+	for _, acct := range config.mercuryAccounts {
+		g.Go(func() error {
+			return run.syncAccount(ctx, acct)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	// Forget failures of transactions that have left the sync window,
+	// unless an account couldn't be fetched and its transactions weren't seen
+	if !run.fetchFailed {
+		for id := range state.FailedTxIDs {
+			if !run.seen[id] {
+				delete(state.FailedTxIDs, id)
+			}
+		}
+	}
+	if len(state.DeadLetterTxIDs) > 0 {
+		slog.Info("Transactions not synced after retries", "count", len(state.DeadLetterTxIDs))
+	}
+
+	slog.Info("Sync completed", "transactions", run.processed, "skipped", run.skipped, "failed", len(run.errs))
+	if run.processed == 0 && len(run.errs) > 0 {
+		return fmt.Errorf("all %d transactions failed to sync: %w", len(run.errs), errors.Join(run.errs...))
+	}
+	if len(run.errs) > 0 {
+		slog.Warn("Some transactions failed to sync", "failed", len(run.errs),
+			"accounts", len(run.failedAccounts), "error", errors.Join(run.errs...))
+	}
+	lastSuccessTimestamp.SetToCurrentTime()
+	return nil
+}
+
+// revertTransaction deletes the InvoiceNinja transaction of a synced Mercury transaction
+// that was later cancelled or failed, and only returns an error when the sync is cancelled
+func (r *syncRun) revertTransaction(ctx context.Context, acct *MercuryAccount, tx *MercuryTransaction, synced *ProcessedTx) error {
+	// Entries from earlier state files don't have the ID, so look it up by reference
+	id := synced.InvoiceNinjaID
+	if id == "" {
+		var err error
+		if id, err = r.client.findInvoiceNinjaTransaction(ctx, tx.ID); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			slog.Warn("Error looking up reversed transaction", "account", acct.Name, "id", tx.ID, "error", err)
+		}
+	}
+
+	if id == "" {
+		slog.Warn("Synced transaction was reversed, but its InvoiceNinja transaction is unknown",
+			"account", acct.Name, "id", tx.ID, "status", tx.Status)
+	} else if err := r.client.deleteInvoiceNinjaTransaction(ctx, id); err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		slog.Error("Error deleting reversed transaction", "account", acct.Name, "id", tx.ID, "error", err)
+		syncErrorsTotal.WithLabelValues(stageDelete).Inc()
+		r.mu.Lock()
+		r.errs = append(r.errs, err)
+		r.failedAccounts[acct.ID] = true
+		r.mu.Unlock()
+		return nil
+	} else {
+		slog.Info("Deleted reversed transaction", "account", acct.Name, "id", tx.ID, "status", tx.Status)
+	}
+
+	if !r.config.DryRun {
+		r.mu.Lock()
+		delete(r.state.ProcessedTxIDs, tx.ID)
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+// filterReason returns why the transaction is filtered out by the config, if it is
+func filterReason(config *Config, tx *MercuryTransaction) string {
+	switch {
+	// InvoiceNinja has no base type for these, and may reject them
+	case tx.Amount == 0:
+		return "zero amount"
+	case math.Abs(tx.Amount) < config.MinAbsAmount:
+		return "below minimum amount"
+	case config.includeDescription != nil && !config.includeDescription.MatchString(tx.BankDescription):
+		return "description not included"
+	case config.excludeDescription != nil && config.excludeDescription.MatchString(tx.BankDescription):
+		return "description excluded"
+	case len(config.IncludeKinds) > 0 && !slices.Contains(config.IncludeKinds, tx.Kind):
+		return "kind not included"
+	case slices.Contains(config.ExcludeKinds, tx.Kind):
+		return "kind excluded"
+	}
+	return ""
+}
+
+// updateTransaction updates the InvoiceNinja transaction of a synced Mercury transaction
+// that changed since, and only returns an error when the sync is cancelled
+func (r *syncRun) updateTransaction(ctx context.Context, acct *MercuryAccount, tx *MercuryTransaction, synced *ProcessedTx, hash string) error {
+	// Entries from earlier versions have no hash, and filtered ones nothing to update
+	if synced.Hash != "" && synced.InvoiceNinjaID != "" {
+		if err := r.client.updateInvoiceNinjaTransaction(ctx, acct, tx, synced.InvoiceNinjaID); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			slog.Error("Error updating changed transaction", "account", acct.Name, "id", tx.ID, "error", err)
+			syncErrorsTotal.WithLabelValues(stageUpdate).Inc()
+			r.mu.Lock()
+			r.errs = append(r.errs, err)
+			r.failedAccounts[acct.ID] = true
+			r.mu.Unlock()
+			return nil
+		}
+		slog.Info("Updated changed transaction", "account", acct.Name, "id", tx.ID, "status", tx.Status)
+	}
+
+	if !r.config.DryRun {
+		r.mu.Lock()
+		r.state.ProcessedTxIDs[tx.ID] = &ProcessedTx{
+			ProcessedAt:    synced.ProcessedAt,
+			InvoiceNinjaID: synced.InvoiceNinjaID,
+			Hash:           hash,
+		}
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+// syncAccount only returns an error when the sync is cancelled or unauthorized,
+// so that a failing account doesn't hold back the others
+func (r *syncRun) syncAccount(ctx context.Context, acct *MercuryAccount) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	config := r.config
+	slog.Debug("Processing account", "name", acct.Name)
+
+	// Only fetch what's new since the last sync, within the sync window,
+	// and overlapping it for transactions that post late
+	since := syncWindowStart(config)
+	overlap := time.Duration(config.FetchOverlapHours) * time.Hour
+	r.mu.Lock()
+	if last, ok := r.state.LastSyncedAt[acct.ID]; ok && !isBackfill(config) && last.Add(-overlap).After(since) {
+		since = last.Add(-overlap)
+	}
+	r.mu.Unlock()
+
+	txs, err := r.client.fetchMercuryTransactions(ctx, acct, since, config.backfillEnd)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// Other accounts would fail the same way, so give up on the sync
+		if errors.Is(err, errAuth) {
+			return fmt.Errorf("error fetching transactions of account %s: %w", acct.Name, err)
+		}
+		slog.Error("Error fetching transactions", "account", acct.Name, "error", err)
+		syncErrorsTotal.WithLabelValues(stageTransactions).Inc()
+		r.mu.Lock()
+		r.fetchFailed = true
+		r.mu.Unlock()
+		return nil
+	}
+	if len(txs) == 0 {
+		return nil
+	}
+	slog.Debug("Processing transactions", "account", acct.Name, "count", len(txs))
+
+	processed, skipped, err := r.processTransactions(ctx, acct, txs)
+	if err != nil {
+		return err
+	}
+	if processed > 0 || skipped > 0 {
+		slog.Info("Account sync completed", "account", acct.Name, "transactions", processed, "skipped", skipped)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.accountCounts[acct.Name] = processed
+	// A backfill doesn't cover the rest of the sync window, so it doesn't count as the last sync
+	// Mercury filters on the creation time, and pending transactions must be fetched again
+	// until they post or are cancelled, so never move past the oldest one
+	if !config.DryRun && !isBackfill(config) && !r.failedAccounts[acct.ID] {
+		last := r.state.LastSyncedAt[acct.ID]
+		var oldestPending time.Time
+		for _, tx := range txs {
+			if tx.CreatedAt.After(last) {
+				last = tx.CreatedAt
+			}
+			if tx.Status == "pending" && (oldestPending.IsZero() || tx.CreatedAt.Before(oldestPending)) {
+				oldestPending = tx.CreatedAt
+			}
+		}
+		if !oldestPending.IsZero() && oldestPending.Before(last) {
+			last = oldestPending
+		}
+		r.state.LastSyncedAt[acct.ID] = last
+	}
+	return nil
+}
+
+// processTransactions syncs the given transactions of the account and returns how many
+// it created and how many were skipped as already synced, and like syncAccount,
+// only returns an error when cancelled or unauthorized
+func (r *syncRun) processTransactions(ctx context.Context, acct *MercuryAccount, txs []*MercuryTransaction) (processed, skipped int, err error) {
+	config := r.config
+
+	// Retry previously failed transactions first
+	r.mu.Lock()
+	sort.SliceStable(txs, func(i, j int) bool {
+		return r.state.FailedTxIDs[txs[i].ID] > 0 && r.state.FailedTxIDs[txs[j].ID] == 0
+	})
+	r.mu.Unlock()
+
+	for _, tx := range txs {
+		r.mu.Lock()
+		r.seen[tx.ID] = true
+		synced := r.state.ProcessedTxIDs[tx.ID]
+		_, dead := r.state.DeadLetterTxIDs[tx.ID]
+		var remoteID string
+		var exists bool
+		filtered := filterReason(config, tx)
+		if synced == nil && !dead && !isReversed(tx) && filtered == "" && r.remote != nil {
+			remoteID, exists = r.remote.take(r.client.newInvoiceNinjaBankTX(acct, tx))
+		}
+		r.mu.Unlock()
+
+		if isReversed(tx) {
+			if synced != nil {
+				if err := r.revertTransaction(ctx, acct, tx, synced); err != nil {
+					return processed, skipped, err
+				}
+			} else {
+				r.mu.Lock()
+				delete(r.state.FailedTxIDs, tx.ID)
+				r.mu.Unlock()
+			}
+			continue
+		}
+		hash := contentHash(config, tx)
+		if synced != nil && synced.Hash != hash {
+			if err := r.updateTransaction(ctx, acct, tx, synced, hash); err != nil {
+				return processed, skipped, err
+			}
+			continue
+		}
+		if synced != nil {
+			slog.Debug("Skipping already processed transaction", "id", tx.ID, "status", tx.Status,
+				"invoice_ninja_id", synced.InvoiceNinjaID)
+			txSkippedTotal.WithLabelValues(skipProcessed).Inc()
+			skipped++
+			r.mu.Lock()
+			r.skipped++
+			r.mu.Unlock()
+			continue
+		}
+		if dead {
+			slog.Debug("Skipping dead-lettered transaction", "id", tx.ID)
+			continue
+		}
+		// Mark filtered transactions processed, so they aren't checked again every sync
+		if filtered != "" {
+			slog.Debug("Skipping filtered transaction", "id", tx.ID, "reason", filtered,
+				"amount", tx.Amount, "description", tx.BankDescription, "kind", tx.Kind)
+			txSkippedTotal.WithLabelValues(skipFiltered).Inc()
+			if !config.DryRun {
+				r.mu.Lock()
+				r.state.ProcessedTxIDs[tx.ID] = &ProcessedTx{ProcessedAt: time.Now(), Hash: hash}
+				r.mu.Unlock()
+			}
+			continue
+		}
+
+		// Without the remote index, look the transaction up individually
+		var err error
+		if r.remote == nil {
+			remoteID, err = r.client.findInvoiceNinjaTransaction(ctx, tx.ID)
+			exists = remoteID != ""
+		}
+		if err == nil && exists {
+			slog.Debug("Skipping transaction already in InvoiceNinja", "id", tx.ID, "invoice_ninja_id", remoteID)
+			txSkippedTotal.WithLabelValues(skipExists).Inc()
+			skipped++
+			r.mu.Lock()
+			r.skipped++
+			if !config.DryRun {
+				r.state.ProcessedTxIDs[tx.ID] = &ProcessedTx{ProcessedAt: time.Now(), InvoiceNinjaID: remoteID, Hash: hash}
+			}
+			r.mu.Unlock()
+			continue
+		}
+		var invoiceNinjaID string
+		if err == nil {
+			invoiceNinjaID, err = r.client.createInvoiceNinjaTransaction(ctx, acct, tx)
+		}
+		if err != nil {
+			// Neither counts against the transaction's retries
+			if ctx.Err() != nil || errors.Is(err, errAuth) {
+				return processed, skipped, err
+			}
+			// Keep going, so one bad transaction doesn't hold back the rest
+			syncErrorsTotal.WithLabelValues(stageCreate).Inc()
+			r.mu.Lock()
+			slog.Error("Error creating transaction", "account", acct.Name, "id", tx.ID,
+				"attempt", r.state.FailedTxIDs[tx.ID]+1, "error", err)
+			r.errs = append(r.errs, err)
+			r.failedAccounts[acct.ID] = true
+			// Dry runs must not use up the retries of the real run
+			if !config.DryRun {
+				if r.state.FailedTxIDs[tx.ID]++; r.state.FailedTxIDs[tx.ID] >= config.MaxRetries {
+					slog.Warn("Giving up on transaction", "account", acct.Name, "id", tx.ID)
+					r.state.DeadLetterTxIDs[tx.ID] = &DeadLetterTx{Error: err.Error(), FailedAt: time.Now()}
+					delete(r.state.FailedTxIDs, tx.ID)
+				}
+			}
+			r.mu.Unlock()
+			continue
+		}
+
+		r.mu.Lock()
+		// Leave dry-run transactions unmarked, so a real run still syncs them
+		if !config.DryRun {
+			slog.Debug("Created transaction", "account", acct.Name, "id", tx.ID, "invoice_ninja_id", invoiceNinjaID)
+			r.state.ProcessedTxIDs[tx.ID] = &ProcessedTx{ProcessedAt: time.Now(), InvoiceNinjaID: invoiceNinjaID, Hash: hash}
+			delete(r.state.FailedTxIDs, tx.ID)
+			txCreatedTotal.Inc()
+		}
+		r.processed++
+		r.mu.Unlock()
+		processed++
+	}
+	return processed, skipped, nil
+}
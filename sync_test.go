@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeAPIs serves the Mercury transactions of a single account, and keeps the bank
+// transactions created in InvoiceNinja so that they can be listed and searched
+type fakeAPIs struct {
+	t          *testing.T
+	mu         sync.Mutex
+	mercuryTxs []map[string]any
+	created    []*InvoiceNinjaBankTX
+	// Like an InvoiceNinja version that doesn't store the transaction reference
+	dropReference bool
+}
+
+// newFakeAPIs returns a client of the given settings with its accounts
+// and bank integrations fetched from the fake APIs
+func newFakeAPIs(t *testing.T, settings map[string]any, txs ...map[string]any) (*fakeAPIs, *Client) {
+	t.Helper()
+	f := &fakeAPIs{t: t, mercuryTxs: txs}
+	c := newTestClient(t, testConfig(t, settings), map[string]http.HandlerFunc{
+		"GET /mercury/accounts": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(t, w, http.StatusOK, map[string]any{
+				"accounts": []map[string]string{{"id": "acct-1", "name": "Checking"}},
+			})
+		},
+		"GET /mercury/account/acct-1/transactions":     f.listMercury,
+		"GET /mercury/account/acct-1/transaction/{id}": f.getMercury,
+		"GET /invoiceninja/bank_integrations": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(t, w, http.StatusOK, map[string]any{
+				"data": []map[string]string{{"id": "bi-1", "provider_name": "Mercury"}},
+			})
+		},
+		"GET /invoiceninja/bank_transactions":         f.listInvoiceNinja,
+		"POST /invoiceninja/bank_transactions":        f.createInvoiceNinja,
+		"PUT /invoiceninja/bank_transactions/{id}":    f.updateInvoiceNinja,
+		"DELETE /invoiceninja/bank_transactions/{id}": f.deleteInvoiceNinja,
+	})
+	ctx := context.Background()
+	if err := c.fetchBankIntegrations(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.fetchMercuryAccounts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return f, c
+}
+
+// mercuryTx returns a Mercury transaction created and posted the given number of days ago
+func mercuryTx(id string, amount float64, status string, daysAgo int) map[string]any {
+	at := time.Now().AddDate(0, 0, -daysAgo).UTC().Format(time.RFC3339)
+	return map[string]any{
+		"id":              id,
+		"amount":          amount,
+		"status":          status,
+		"bankDescription": "Transaction " + id,
+		"kind":            "debitCardTransaction",
+		"createdAt":       at,
+		"postedAt":        at,
+	}
+}
+
+func (f *fakeAPIs) listMercury(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	txs := []map[string]any{}
+	if r.URL.Query().Get("offset") == "0" {
+		for _, tx := range f.mercuryTxs {
+			if tx["status"] == r.URL.Query().Get("status") {
+				txs = append(txs, tx)
+			}
+		}
+	}
+	writeJSON(f.t, w, http.StatusOK, map[string]any{"total": len(txs), "transactions": txs})
+}
+
+func (f *fakeAPIs) getMercury(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, tx := range f.mercuryTxs {
+		if tx["id"] == r.PathValue("id") {
+			writeJSON(f.t, w, http.StatusOK, tx)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// listInvoiceNinja searches like InvoiceNinja's filter parameter, which matches parts of fields
+func (f *fakeAPIs) listInvoiceNinja(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	filter := r.URL.Query().Get("filter")
+	txs := []*InvoiceNinjaBankTX{}
+	for _, tx := range f.created {
+		if strings.Contains(tx.Description, filter) || strings.Contains(tx.TransactionReference, filter) {
+			txs = append(txs, tx)
+		}
+	}
+	writeJSON(f.t, w, http.StatusOK, map[string]any{
+		"data": txs,
+		"meta": map[string]any{"pagination": map[string]int{"current_page": 1, "total_pages": 1}},
+	})
+}
+
+func (f *fakeAPIs) createInvoiceNinja(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var tx InvoiceNinjaBankTX
+	if err := json.NewDecoder(r.Body).Decode(&tx); err != nil {
+		f.t.Error(err)
+	}
+	tx.ID = fmt.Sprintf("bt-%d", len(f.created)+1)
+	if f.dropReference {
+		tx.TransactionReference = ""
+	}
+	f.created = append(f.created, &tx)
+	writeJSON(f.t, w, http.StatusOK, map[string]any{"data": tx})
+}
+
+func (f *fakeAPIs) updateInvoiceNinja(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, tx := range f.created {
+		if tx.ID == r.PathValue("id") {
+			if err := json.NewDecoder(r.Body).Decode(tx); err != nil {
+				f.t.Error(err)
+			}
+			tx.ID = r.PathValue("id")
+			writeJSON(f.t, w, http.StatusOK, map[string]any{"data": tx})
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (f *fakeAPIs) deleteInvoiceNinja(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, tx := range f.created {
+		if tx.ID == r.PathValue("id") {
+			f.created = append(f.created[:i], f.created[i+1:]...)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// createdDescriptions returns the descriptions of the created InvoiceNinja transactions
+func (f *fakeAPIs) createdDescriptions() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var descs []string
+	for _, tx := range f.created {
+		descs = append(descs, tx.Description)
+	}
+	return descs
+}
+
+func TestSyncKeepsProcessedWithinWindow(t *testing.T) {
+	c := newTestClient(t, testConfig(t, map[string]any{"syncStartDaysAgo": 30}), nil)
+	state := newSyncState()
+	state.ProcessedTxIDs["tx-day-20"] = &ProcessedTx{ProcessedAt: time.Now().AddDate(0, 0, -20)}
+	state.ProcessedTxIDs["tx-day-40"] = &ProcessedTx{ProcessedAt: time.Now().AddDate(0, 0, -40)}
+
+	if err := syncTransactions(context.Background(), c, state); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.ProcessedTxIDs["tx-day-20"]; !ok {
+		t.Error("transaction processed 20 days ago was pruned within a 30-day window")
+	}
+	if _, ok := state.ProcessedTxIDs["tx-day-40"]; ok {
+		t.Error("transaction processed 40 days ago was kept beyond a 30-day window")
+	}
+}
+
+func TestSyncExcludesKinds(t *testing.T) {
+	transfer := mercuryTx("tx-1", -100, "sent", 1)
+	transfer["kind"] = "internalTransfer"
+	f, c := newFakeAPIs(t, map[string]any{"excludeKinds": []string{"internalTransfer"}},
+		transfer, mercuryTx("tx-2", -20, "sent", 1))
+
+	state := newSyncState()
+	if err := syncTransactions(context.Background(), c, state); err != nil {
+		t.Fatal(err)
+	}
+	if descs := f.createdDescriptions(); len(descs) != 1 || descs[0] != "Transaction tx-2" {
+		t.Errorf("created = %q, want only tx-2", descs)
+	}
+	// Marked processed, so it isn't checked again
+	if synced := state.ProcessedTxIDs["tx-1"]; synced == nil || synced.InvoiceNinjaID != "" {
+		t.Errorf("excluded transaction state = %+v", synced)
+	}
+}
+
+func TestSyncSkipsZeroAmount(t *testing.T) {
+	f, c := newFakeAPIs(t, nil, mercuryTx("tx-1", 0, "sent", 1), mercuryTx("tx-2", -20, "sent", 1))
+	filtered := testutil.ToFloat64(txSkippedTotal.WithLabelValues(skipFiltered))
+	processed := testutil.ToFloat64(txSkippedTotal.WithLabelValues(skipProcessed))
+
+	state := newSyncState()
+	if err := syncTransactions(context.Background(), c, state); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(txSkippedTotal.WithLabelValues(skipFiltered)) - filtered; got != 1 {
+		t.Errorf("filtered skips = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(txSkippedTotal.WithLabelValues(skipProcessed)) - processed; got != 0 {
+		t.Errorf("already processed skips = %v, want 0", got)
+	}
+	if descs := f.createdDescriptions(); len(descs) != 1 || descs[0] != "Transaction tx-2" {
+		t.Errorf("created = %q, want only tx-2", descs)
+	}
+	if state.ProcessedTxIDs["tx-1"] == nil {
+		t.Error("zero-amount transaction wasn't marked processed")
+	}
+	if len(state.FailedTxIDs) > 0 {
+		t.Errorf("failed = %v, want none", state.FailedTxIDs)
+	}
+}
+
+func TestSyncWaitsForWebhookSync(t *testing.T) {
+	f, c := newFakeAPIs(t, nil, mercuryTx("tx-1", -20, "sent", 1))
+	state := newSyncState()
+
+	// Like a webhook-driven sync or a save in progress
+	syncing.Lock()
+	done := make(chan error)
+	go func() { done <- syncTransactions(context.Background(), c, state) }()
+	time.Sleep(100 * time.Millisecond)
+	syncing.Unlock()
+
+	if err := <-done; err != nil {
+		t.Fatalf("error = %v, want the sync to run once the webhook is done", err)
+	}
+	if descs := f.createdDescriptions(); len(descs) != 1 {
+		t.Errorf("created = %q, want tx-1", descs)
+	}
+}
+
+func TestSyncSkipsWhileScheduledSyncRuns(t *testing.T) {
+	_, c := newFakeAPIs(t, nil, mercuryTx("tx-1", -20, "sent", 1))
+	state := newSyncState()
+
+	scheduledSync.Lock()
+	defer scheduledSync.Unlock()
+	if err := syncTransactions(context.Background(), c, state); !errors.Is(err, errSyncSkipped) {
+		t.Errorf("error = %v, want errSyncSkipped", err)
+	}
+	if len(state.ProcessedTxIDs) > 0 {
+		t.Errorf("processed = %v, want none", state.ProcessedTxIDs)
+	}
+}
+
+func TestSyncLastSyncedAtHeldAtPending(t *testing.T) {
+	pending := mercuryTx("tx-1", -20, "pending", 3)
+	sent := mercuryTx("tx-2", -30, "sent", 2)
+	sent["postedAt"] = time.Now().UTC().Format(time.RFC3339)
+	_, c := newFakeAPIs(t, map[string]any{"mercuryTransactionStatus": "pending,sent", "fetchOverlapHours": 1},
+		pending, sent)
+
+	state := newSyncState()
+	if err := syncTransactions(context.Background(), c, state); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := state.LastSyncedAt["acct-1"].Format(time.RFC3339), pending["createdAt"]; got != want {
+		t.Errorf("last synced at = %s, want the creation of the pending transaction %s", got, want)
+	}
+
+	// Once it posts, the mark moves on to the newest creation time
+	pending["status"] = "sent"
+	if err := syncTransactions(context.Background(), c, state); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := state.LastSyncedAt["acct-1"].Format(time.RFC3339), sent["createdAt"]; got != want {
+		t.Errorf("last synced at = %s, want the newest creation %s", got, want)
+	}
+}
+
+func TestLoadConfigFetchOverlapDefaultsToWindow(t *testing.T) {
+	config := testConfig(t, map[string]any{"syncStartDaysAgo": 10})
+	if config.FetchOverlapHours != 10*24 {
+		t.Errorf("fetch overlap = %dh, want the whole window of 240h", config.FetchOverlapHours)
+	}
+}
+
+func TestDryRunDoesNotCountFailures(t *testing.T) {
+	unmapped := mercuryTx("tx-1", -20, "sent", 1)
+	unmapped["currency"] = "CAD"
+	_, c := newFakeAPIs(t, map[string]any{"dryRun": true, "maxRetries": 1}, unmapped)
+
+	state := newSyncState()
+	if err := syncTransactions(context.Background(), c, state); err == nil {
+		t.Fatal("sync of an unmapped currency succeeded")
+	}
+	if len(state.FailedTxIDs) > 0 || len(state.DeadLetterTxIDs) > 0 {
+		t.Errorf("failed = %v, dead-lettered = %v, want neither in a dry run", state.FailedTxIDs, state.DeadLetterTxIDs)
+	}
+}
+
+func TestSyncFindsCreatedTransactionsWithoutState(t *testing.T) {
+	tests := []struct {
+		name          string
+		settings      map[string]any
+		dropReference bool
+	}{
+		{"by reference", nil, false},
+		{"by reference in remote index", map[string]any{"remoteDedup": true}, false},
+		{"by description", map[string]any{"appendTxIDToDescription": true}, true},
+		{"by description in remote index", map[string]any{"appendTxIDToDescription": true, "remoteDedup": true}, true},
+		// The suffix is added once the reference turns out not to be stored
+		{"by description by default", nil, true},
+		{"by description by default in remote index", map[string]any{"remoteDedup": true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, c := newFakeAPIs(t, tt.settings, mercuryTx("tx-1", -20, "sent", 1))
+			f.dropReference = tt.dropReference
+			if err := syncTransactions(context.Background(), c, newSyncState()); err != nil {
+				t.Fatal(err)
+			}
+
+			if descs := f.createdDescriptions(); tt.dropReference && (len(descs) != 1 || descs[0] != "Transaction tx-1 [mercury:tx-1]") {
+				t.Errorf("created = %q, want tx-1 with its Mercury ID", descs)
+			}
+
+			// As if the state was lost
+			state := newSyncState()
+			if err := syncTransactions(context.Background(), c, state); err != nil {
+				t.Fatal(err)
+			}
+			if descs := f.createdDescriptions(); len(descs) != 1 {
+				t.Errorf("created = %q, want tx-1 once", descs)
+			}
+			if synced := state.ProcessedTxIDs["tx-1"]; synced == nil || synced.InvoiceNinjaID != "bt-1" {
+				t.Errorf("state = %+v, want tx-1 found as bt-1", synced)
+			}
+		})
+	}
+}
+
+func TestReconcileStateFromReferenceAndDescription(t *testing.T) {
+	f, c := newFakeAPIs(t, nil)
+	today := time.Now().Format("2006-01-02")
+	f.created = []*InvoiceNinjaBankTX{
+		{ID: "bt-1", Date: today, BankIntegrationID: "bi-1", TransactionReference: "tx-1", Description: "Coffee"},
+		{ID: "bt-2", Date: today, BankIntegrationID: "bi-1", Description: "Lunch [mercury:tx-2]"},
+		{ID: "bt-3", Date: today, BankIntegrationID: "bi-1", Description: "Created by hand"},
+	}
+
+	state := newSyncState()
+	if err := reconcileState(context.Background(), c, state); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]string{"tx-1": "bt-1", "tx-2": "bt-2"} {
+		if synced := state.ProcessedTxIDs[id]; synced == nil || synced.InvoiceNinjaID != want {
+			t.Errorf("state of %s = %+v, want %s", id, synced, want)
+		}
+	}
+	if len(state.ProcessedTxIDs) != 2 {
+		t.Errorf("state = %v, want only tx-1 and tx-2", state.ProcessedTxIDs)
+	}
+}
+
+func TestSyncPrunesByCountOutsideWindowOnly(t *testing.T) {
+	c := newTestClient(t, testConfig(t, map[string]any{"maxStateEntries": 2, "dedupRetentionDays": 30}), nil)
+	state := newSyncState()
+	for _, days := range []int{1, 2, 3, 10, 20} {
+		state.ProcessedTxIDs[fmt.Sprintf("tx-day-%d", days)] = &ProcessedTx{ProcessedAt: time.Now().AddDate(0, 0, -days)}
+	}
+
+	if err := syncTransactions(context.Background(), c, state); err != nil {
+		t.Fatal(err)
+	}
+	for _, days := range []int{1, 2, 3} {
+		if _, ok := state.ProcessedTxIDs[fmt.Sprintf("tx-day-%d", days)]; !ok {
+			t.Errorf("transaction processed %d days ago, within the sync window, was pruned", days)
+		}
+	}
+	if len(state.ProcessedTxIDs) != 3 {
+		t.Errorf("state = %v, want the older transactions pruned", state.ProcessedTxIDs)
+	}
+}
+
+func TestSyncSkipsLookupWithoutMercuryID(t *testing.T) {
+	f, c := newFakeAPIs(t, map[string]any{"appendTxIDToDescription": false},
+		mercuryTx("tx-1", -20, "sent", 1), mercuryTx("tx-2", -30, "sent", 1))
+	f.dropReference = true
+	lookups := 0
+	list := f.listInvoiceNinja
+	c = newTestClient(t, c.config, map[string]http.HandlerFunc{
+		"GET /mercury/account/acct-1/transactions": f.listMercury,
+		"GET /invoiceninja/bank_transactions": func(w http.ResponseWriter, r *http.Request) {
+			lookups++
+			list(w, r)
+		},
+		"POST /invoiceninja/bank_transactions": f.createInvoiceNinja,
+	})
+	if err := syncTransactions(context.Background(), c, newSyncState()); err != nil {
+		t.Fatal(err)
+	}
+	if descs := f.createdDescriptions(); len(descs) != 2 || strings.Contains(descs[0]+descs[1], "[mercury:") {
+		t.Errorf("created = %q, want both without the Mercury ID", descs)
+	}
+	// Once the reference turns out not to be stored, looking up the transaction can't find it
+	if lookups != 1 {
+		t.Errorf("got %d lookups, want 1", lookups)
+	}
+}
+
+func TestBackfillSkipsTransactionsPrunedFromState(t *testing.T) {
+	old := mercuryTx("tx-1", -20, "sent", 30)
+	f, c := newFakeAPIs(t, nil, old, mercuryTx("tx-2", -30, "sent", 29))
+	// Created by a sync long enough ago that the state has forgotten it
+	f.created = []*InvoiceNinjaBankTX{{
+		ID:                "bt-1",
+		Amount:            20,
+		Date:              time.Now().AddDate(0, 0, -30).UTC().Format("2006-01-02"),
+		Description:       "Transaction tx-1",
+		BankIntegrationID: "bi-1",
+		BaseType:          "DEBIT",
+	}}
+	start := time.Now().AddDate(0, 0, -31).Format("2006-01-02")
+	if err := setBackfill(c.config, start, time.Now().AddDate(0, 0, -28).Format("2006-01-02")); err != nil {
+		t.Fatal(err)
+	}
+
+	state := newSyncState()
+	if err := syncTransactions(context.Background(), c, state); err != nil {
+		t.Fatal(err)
+	}
+	if descs := f.createdDescriptions(); len(descs) != 2 || descs[1] != "Transaction tx-2" {
+		t.Errorf("created = %q, want only tx-2 added", descs)
+	}
+	if synced := state.ProcessedTxIDs["tx-1"]; synced == nil || synced.InvoiceNinjaID != "bt-1" {
+		t.Errorf("state = %+v, want tx-1 found as bt-1", synced)
+	}
+}
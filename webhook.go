@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Webhooks signed longer ago than this are rejected, so they can't be replayed
+const webhookSignatureTolerance = 5 * time.Minute
+
+// MercuryWebhookEvent is the part of a Mercury webhook event that the sync needs
+type MercuryWebhookEvent struct {
+	ResourceType  string `json:"resourceType"`
+	ResourceID    string `json:"resourceId"`
+	OperationType string `json:"operationType"`
+}
+
+// verifyMercurySignature checks a Mercury-Signature header of the form t=<unix time>,v1=<signature>,
+// where the signature is the hex HMAC-SHA256 of "<unix time>.<body>" keyed by the webhook secret
+func verifyMercurySignature(secret, header string, body []byte, now time.Time) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("missing signature timestamp")
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > webhookSignatureTolerance || age < -webhookSignatureTolerance {
+		return fmt.Errorf("signature timestamp out of tolerance: %s", time.Unix(unix, 0).Format(time.RFC3339))
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s.", timestamp)
+	mac.Write(body)
+	expected := mac.Sum(nil)
+	for _, signature := range signatures {
+		if decoded, err := hex.DecodeString(signature); err == nil && hmac.Equal(decoded, expected) {
+			return nil
+		}
+	}
+	return errors.New("signature mismatch")
+}
+
+// startWebhookServer receives Mercury webhooks and syncs the transactions they notify about
+// right away, while the scheduled syncs still pick up the ones that were missed
+func startWebhookServer(ctx context.Context, c *Client, state *SyncState, store StateStore) {
+	// Taken at startup, like the port, rather than from reloaded configs
+	secret := c.config.MercuryWebhookSecret
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /webhooks/mercury", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "error reading body", http.StatusBadRequest)
+			return
+		}
+		if err := verifyMercurySignature(secret, r.Header.Get("Mercury-Signature"), body, time.Now()); err != nil {
+			slog.Warn("Rejected Mercury webhook", "error", err)
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		var event MercuryWebhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			http.Error(w, "invalid event", http.StatusBadRequest)
+			return
+		}
+		slog.Debug("Received Mercury webhook", "resource_type", event.ResourceType,
+			"id", event.ResourceID, "operation", event.OperationType)
+		if event.ResourceType != "transaction" || event.ResourceID == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// Answer right away, since syncing may wait for a scheduled sync to finish
+		w.WriteHeader(http.StatusAccepted)
+		go func() {
+			if err := syncWebhookTransaction(ctx, c, state, event.ResourceID); err != nil {
+				slog.Error("Error syncing webhook transaction", "id", event.ResourceID, "error", err)
+			}
+			if err := saveState(c.config, store, state); err != nil {
+				slog.Error("Error saving state", "error", err)
+			}
+		}()
+	})
+
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", c.config.WebhookPort),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	go func() {
+		slog.Debug("Starting webhook server", "addr", server.Addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("Error in webhook server", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mercurySignature(secret string, t time.Time, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.%s", t.Unix(), body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyMercurySignature(t *testing.T) {
+	const secret = "test-webhook-secret"
+	const body = `{"resourceType": "transaction", "resourceId": "tx-1"}`
+	now := time.Now()
+	valid := mercurySignature(secret, now, body)
+	tests := []struct {
+		name   string
+		header string
+		valid  bool
+	}{
+		{"valid", fmt.Sprintf("t=%d,v1=%s", now.Unix(), valid), true},
+		{"valid with spaces", fmt.Sprintf("t=%d, v1=%s", now.Unix(), valid), true},
+		{"bad signature", fmt.Sprintf("t=%d,v1=%s", now.Unix(), mercurySignature("other-secret", now, body)), false},
+		{"signature of another body", fmt.Sprintf("t=%d,v1=%s", now.Unix(), mercurySignature(secret, now, "{}")), false},
+		{"signature not hex", fmt.Sprintf("t=%d,v1=not-hex", now.Unix()), false},
+		{"missing signature", fmt.Sprintf("t=%d", now.Unix()), false},
+		{"missing timestamp", "v1=" + valid, false},
+		{"garbled timestamp", "t=yesterday,v1=" + valid, false},
+		{"empty header", "", false},
+		{"timestamp too old", fmt.Sprintf("t=%d,v1=%s", now.Add(-10*time.Minute).Unix(),
+			mercurySignature(secret, now.Add(-10*time.Minute), body)), false},
+		{"timestamp too new", fmt.Sprintf("t=%d,v1=%s", now.Add(10*time.Minute).Unix(),
+			mercurySignature(secret, now.Add(10*time.Minute), body)), false},
+		{"timestamp within tolerance", fmt.Sprintf("t=%d,v1=%s", now.Add(-4*time.Minute).Unix(),
+			mercurySignature(secret, now.Add(-4*time.Minute), body)), true},
+		// Such as while the secret is rotated
+		{"one of several signatures", fmt.Sprintf("t=%d,v1=%s,v1=%s", now.Unix(),
+			mercurySignature("old-secret", now, body), valid), true},
+		{"none of several signatures", fmt.Sprintf("t=%d,v1=%s,v1=%s", now.Unix(),
+			mercurySignature("old-secret", now, body), mercurySignature("other-secret", now, body)), false},
+	}
+	for _, tt := range tests {
+		err := verifyMercurySignature(secret, tt.header, []byte(body), now)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: error = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestWebhookRejectsUnsignedRequests(t *testing.T) {
+	// Take a free port for the webhook server
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := testConfig(t, map[string]any{"webhookPort": port, "mercuryWebhookSecret": "test-webhook-secret"})
+	startWebhookServer(ctx, newClient(config), newSyncState(), nil)
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/webhooks/mercury", port)
+	body := `{"resourceType": "transaction", "resourceId": "tx-1"}`
+	var res *http.Response
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if res, err = http.Post(url, "application/json", strings.NewReader(body)); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", res.StatusCode, http.StatusUnauthorized)
+	}
+}